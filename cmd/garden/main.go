@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"time"
 
+	gardenapi "code.cloudfoundry.org/garden"
 	"code.cloudfoundry.org/lager"
+	"github.com/concourse/concourse/worker/baggageclaim/client"
 	"github.com/concourse/flag"
 	"github.com/concourse/kubernetes-worker/pkg/garden"
 	"github.com/jessevdk/go-flags"
@@ -24,11 +28,33 @@ type Opts struct {
 	Logger       flag.Lager
 	KlogLogLevel *klog.Level `long:"klog-log-level" default:"2" description:"Verbosity of the klog logger, used by the Kubernetes libraries."`
 
-	BindAddress     string `long:"bind-address" default:"tcp://:7777" description:"Address on which to serve the Garden API."`
-	Namespace       string `long:"namespace" required:"true" description:"Kubernetes namespace to monitor for pod."`
-	PodName         string `long:"pod-name" required:"true" description:"Name of this pod."`
-	WorkerName      string `long:"worker-name" required:"true" description:"Name of this worker."`
-	WorkerLabelName string `long:"worker-label-name" default:"k8s.concourse-ci.org/worker" description:"Name of the label to add to the pod containing the worker's name"`
+	BaggageClaimAddress string `long:"baggage-claim-address" required:"true" description:"Address on which the Baggage Claim API for this node is being served."`
+	BindAddress         string `long:"bind-address" default:"tcp://:7777" description:"Address on which to serve the Garden API."`
+	CsiDriverName       string `long:"csi-driver-name" default:"baggageclaim.k8s.concourse-ci.org" description:"Name of the CSI driver used to mount volumes into pods."`
+	Namespace           string `long:"namespace" required:"true" description:"Kubernetes namespace to monitor for pod."`
+	PodName             string `long:"pod-name" required:"true" description:"Name of this pod."`
+	WorkerName          string `long:"worker-name" required:"true" description:"Name of this worker."`
+	WorkerLabelName     string `long:"worker-label-name" default:"k8s.concourse-ci.org/worker" description:"Name of the label to add to the pod containing the worker's name"`
+
+	DenyNetworkEgress bool `long:"deny-network-egress" description:"Deny containers all outbound network traffic, other than what is allowed by NetOut rules. Without this, NetOut rules have no effect."`
+
+	RawImageBase string `long:"raw-image-base" default:"busybox:1.35" description:"Image to run containers with a raw:// rootfs in, which only needs to be able to run the init binary."`
+
+	PodStartTimeout time.Duration `long:"pod-start-timeout" default:"5m" description:"Duration after which a container which hasn't become ready should be considered failed."`
+	StopTimeout     time.Duration `long:"stop-timeout" default:"10s" description:"Duration to wait for processes to exit after being terminated, before they are killed."`
+
+	CapacitySource string `long:"capacity-source" default:"node" choice:"node" choice:"quota" description:"Where to derive the worker's capacity from; the allocatable resources of its node, or the resource quotas of its namespace."`
+	MaxContainers  uint64 `long:"max-containers" default:"250" description:"Maximum number of containers to report as the worker's capacity."`
+
+	DefaultCPUWeight   uint64 `long:"default-cpu-weight" description:"CPU weight given to containers which don't specify one, where 1024 corresponds to a single CPU."`
+	DefaultMemoryLimit uint64 `long:"default-memory-limit" description:"Memory limit, in bytes, given to containers which don't specify one."`
+	DefaultDiskLimit   uint64 `long:"default-disk-limit" description:"Ephemeral storage limit, in bytes, given to containers which don't specify one."`
+	MaxCPUWeight       uint64 `long:"max-cpu-weight" description:"Maximum CPU weight a container can be given."`
+	MaxMemoryLimit     uint64 `long:"max-memory-limit" description:"Maximum memory limit, in bytes, a container can be given."`
+	MaxDiskLimit       uint64 `long:"max-disk-limit" description:"Maximum ephemeral storage limit, in bytes, a container can be given."`
+
+	PingCacheDuration time.Duration `long:"ping-cache-duration" default:"30s" description:"Duration for which the result of checking access to the Kubernetes API is reused when the Garden API is pinged."`
+	ReapInterval      time.Duration `long:"reap-interval" default:"1m" description:"Interval on which containers which have outlived their grace time are destroyed."`
 }
 
 func main() {
@@ -67,20 +93,64 @@ func main() {
 		logger.Fatal("failed-to-initialize-api-client", err)
 	}
 
-	if err := patchWorkerLabel(kubernetesClient, opts); err != nil {
+	workerPod, err := patchWorkerLabel(kubernetesClient, opts)
+	if err != nil {
 		logger.Fatal("failed-to-patch-worker-label", err)
 	}
 
-	gardenServer := garden.NewGardenServer(
+	baggageClaimClient := client.NewWithHTTPClient(
+		opts.BaggageClaimAddress,
+
+		// ensure we don't use baggageclaim's default retryhttp client; all
+		// traffic should be local, so any failures are unlikely to be transient.
+		&http.Client{
+			Transport: &http.Transport{
+				// don't let a slow (possibly stuck) baggageclaim server hold up
+				// requests from the atc
+				ResponseHeaderTimeout: 1 * time.Minute,
+			},
+		},
+	)
+
+	gardenServer, err := garden.NewGardenServer(
 		logger,
 		garden.Config{
 			BindNetwork: gardenUrl.Scheme,
 			BindAddress: gardenUrl.Host,
 			Namespace:   opts.Namespace,
+			NodeName:    workerPod.Spec.NodeName,
 			WorkerName:  opts.WorkerName,
+
+			CsiDriverName:     opts.CsiDriverName,
+			DenyNetworkEgress: opts.DenyNetworkEgress,
+			RawImageBase:      opts.RawImageBase,
+			PodStartTimeout:   opts.PodStartTimeout,
+			StopTimeout:       opts.StopTimeout,
+
+			CapacitySource: opts.CapacitySource,
+			MaxContainers:  opts.MaxContainers,
+
+			DefaultLimits: gardenapi.Limits{
+				CPU:    gardenapi.CPULimits{Weight: opts.DefaultCPUWeight},
+				Memory: gardenapi.MemoryLimits{LimitInBytes: opts.DefaultMemoryLimit},
+				Disk:   gardenapi.DiskLimits{ByteHard: opts.DefaultDiskLimit},
+			},
+			MaxLimits: gardenapi.Limits{
+				CPU:    gardenapi.CPULimits{Weight: opts.MaxCPUWeight},
+				Memory: gardenapi.MemoryLimits{LimitInBytes: opts.MaxMemoryLimit},
+				Disk:   gardenapi.DiskLimits{ByteHard: opts.MaxDiskLimit},
+			},
+
+			PingCacheDuration: opts.PingCacheDuration,
+			ReapInterval:      opts.ReapInterval,
 		},
 		kubernetesClient,
+		kubernetesConfig,
+		baggageClaimClient,
 	)
+	if err != nil {
+		logger.Fatal("failed-to-create-garden-server", err)
+	}
 
 	err = gardenServer.Start(context.Background())
 	if err != nil {
@@ -94,38 +164,36 @@ func (cmd *Opts) constructLogger() (lager.Logger, *lager.ReconfigurableSink) {
 	return logger, reconfigurableSink
 }
 
-func patchWorkerLabel(client *kubernetes.Clientset, opts *Opts) error {
+func patchWorkerLabel(client *kubernetes.Clientset, opts *Opts) (*corev1.Pod, error) {
 	podClient := client.CoreV1().Pods(opts.Namespace)
 
 	pod, err := podClient.Get(context.Background(), opts.PodName, metav1.GetOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	originalPodJson, err := json.Marshal(pod)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	pod.ObjectMeta.Labels[opts.WorkerLabelName] = opts.WorkerName
 
 	updatedPodJson, err := json.Marshal(pod)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	patchData, err := strategicpatch.CreateTwoWayMergePatch(originalPodJson, updatedPodJson, corev1.Pod{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = podClient.Patch(
+	return podClient.Patch(
 		context.Background(),
 		opts.PodName,
 		types.StrategicMergePatchType,
 		patchData,
 		metav1.PatchOptions{},
 	)
-
-	return err
 }
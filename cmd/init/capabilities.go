@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilities which a container can be given for init's sake, beyond the
+// defaults, and which its processes have to go without
+var capabilities = map[string]int{
+	"SYS_ADMIN": unix.CAP_SYS_ADMIN,
+}
+
+// dropCapabilities removes capabilities from every one of our sets, including
+// the bounding set, so nothing we exec can ever regain them
+func dropCapabilities(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to get capabilities: %w", err)
+	}
+
+	for _, name := range names {
+		capability, found := capabilities[strings.ToUpper(strings.TrimPrefix(name, "CAP_"))]
+		if !found {
+			return fmt.Errorf("unknown capability '%s'", name)
+		}
+
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to drop capability '%s' from bounding set: %w", name, err)
+		}
+
+		mask := uint32(1) << (capability % 32)
+		data[capability/32].Effective &^= mask
+		data[capability/32].Permitted &^= mask
+		data[capability/32].Inheritable &^= mask
+	}
+
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+
+	return nil
+}
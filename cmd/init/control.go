@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlFifo is read by the keeper of a detached process, to carry the
+// requests an exec session can't; signalling the process and resizing its tty
+const controlFifo = "control"
+
+var errNotRunning = errors.New("process is no longer running")
+
+// sendControl passes a request on to the keeper of a detached process
+func sendControl(dir string, request ...string) error {
+	// opening without blocking fails straight away if nothing is reading,
+	// rather than waiting on a keeper which has already gone
+	control, err := os.OpenFile(filepath.Join(dir, controlFifo), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return errNotRunning
+	}
+
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	_, err = fmt.Fprintln(control, strings.Join(request, " "))
+	return err
+}
+
+// signalAll passes a signal on to every detached process still running.
+// Signalling them through their keepers, rather than signalling everything,
+// leaves the keepers alive to record each process' exit status.
+func signalAll(processesDir, signal string) error {
+	entries, err := os.ReadDir(processesDir)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(processesDir, entry.Name())
+		if _, exited, err := readExitStatus(dir); err == nil && exited {
+			continue
+		}
+
+		err := sendControl(dir, "signal", signal)
+		if err != nil && !errors.Is(err, errNotRunning) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to signal process in '%s': %w", dir, err)
+		}
+	}
+
+	return firstErr
+}
+
+// handleControl acts on requests sent to a detached process' keeper, until
+// the keeper exits
+func handleControl(control *os.File, pid int, tty *os.File) {
+	scanner := bufio.NewScanner(control)
+	for scanner.Scan() {
+		request := strings.Fields(scanner.Text())
+		if len(request) != 2 {
+			continue
+		}
+
+		switch request[0] {
+		case "signal":
+			if sig, found := signals[request[1]]; found {
+				_ = syscall.Kill(-pid, sig)
+			}
+
+		case "resize":
+			size, err := parseWindowSize(request[1])
+			if err == nil && tty != nil {
+				_ = unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, size)
+			}
+		}
+	}
+}
+
+// parseWindowSize parses a window size given as COLUMNSxROWS
+func parseWindowSize(size string) (*unix.Winsize, error) {
+	parts := strings.SplitN(size, "x", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed window size '%s'", size)
+	}
+
+	columns, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed window size '%s': %w", size, err)
+	}
+
+	rows, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed window size '%s': %w", size, err)
+	}
+
+	return &unix.Winsize{
+		Col: uint16(columns),
+		Row: uint16(rows),
+	}, nil
+}
+
+// openPTY allocates a new pseudo-terminal, returning both of its ends
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+
+	number, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to find pty: %w", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseWindowSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected unix.Winsize
+		err      bool
+	}{
+		{size: "80x24", expected: unix.Winsize{Col: 80, Row: 24}},
+		{size: "0x0", expected: unix.Winsize{}},
+		{size: "65535x65535", expected: unix.Winsize{Col: 65535, Row: 65535}},
+		{size: "65536x24", err: true},
+		{size: "80", err: true},
+		{size: "80x", err: true},
+		{size: "x24", err: true},
+		{size: "-80x24", err: true},
+		{size: "80x24x1", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.size, func(t *testing.T) {
+			size, err := parseWindowSize(test.size)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", size)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if *size != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, *size)
+			}
+		})
+	}
+}
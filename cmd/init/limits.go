@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var rlimits = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+type rlimit struct {
+	resource int
+	limit    unix.Rlimit
+}
+
+// parseRlimits parses limits given as NAME=SOFT[:HARD], where the hard limit
+// defaults to the soft limit
+func parseRlimits(limits []string) ([]rlimit, error) {
+	parsed := make([]rlimit, 0, len(limits))
+	for _, limit := range limits {
+		parts := strings.SplitN(limit, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed rlimit '%s'", limit)
+		}
+
+		resource, found := rlimits[strings.ToLower(parts[0])]
+		if !found {
+			return nil, fmt.Errorf("unknown rlimit '%s'", parts[0])
+		}
+
+		values := strings.SplitN(parts[1], ":", 2)
+
+		soft, err := strconv.ParseUint(values[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed rlimit '%s': %w", limit, err)
+		}
+
+		hard := soft
+		if len(values) == 2 {
+			hard, err = strconv.ParseUint(values[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed rlimit '%s': %w", limit, err)
+			}
+		}
+
+		parsed = append(parsed, rlimit{
+			resource: resource,
+			limit:    unix.Rlimit{Cur: soft, Max: hard},
+		})
+	}
+
+	return parsed, nil
+}
+
+// setRlimits applies limits to ourselves, and so to anything we exec
+func setRlimits(limits []rlimit) error {
+	for _, limit := range limits {
+		limit := limit
+
+		err := unix.Setrlimit(limit.resource, &limit.limit)
+		if err != nil {
+			return fmt.Errorf("failed to set rlimit %d to %d:%d: %w", limit.resource, limit.limit.Cur, limit.limit.Max, err)
+		}
+	}
+
+	return nil
+}
+
+// setUmask applies a umask given in octal
+func setUmask(umask string) error {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		return fmt.Errorf("malformed umask '%s': %w", umask, err)
+	}
+
+	syscall.Umask(int(mask))
+	return nil
+}
+
+// writeEnvFile writes the environment file read by readEnvFile, from stdin.
+// It's only readable by root, as it's likely to contain credentials.
+func writeEnvFile(path string, contents io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, contents); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// readEnvFile reads environment variables from a file of NUL separated
+// NAME=VALUE entries, the same format as /proc/<pid>/environ, so values can
+// contain anything but NUL
+func readEnvFile(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	env := []string{}
+	for _, entry := range bytes.Split(contents, []byte{0}) {
+		if len(entry) == 0 {
+			continue
+		}
+
+		if !bytes.Contains(entry, []byte("=")) {
+			return nil, fmt.Errorf("malformed environment variable '%s' in '%s'", entry, path)
+		}
+
+		env = append(env, string(entry))
+	}
+
+	return env, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRlimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   []string
+		expected []rlimit
+		err      bool
+	}{
+		{
+			name:     "no limits",
+			expected: []rlimit{},
+		},
+		{
+			name:   "soft limit only",
+			limits: []string{"nofile=1024"},
+			expected: []rlimit{
+				{resource: unix.RLIMIT_NOFILE, limit: unix.Rlimit{Cur: 1024, Max: 1024}},
+			},
+		},
+		{
+			name:   "soft and hard limits",
+			limits: []string{"NOFILE=1024:4096", "core=0"},
+			expected: []rlimit{
+				{resource: unix.RLIMIT_NOFILE, limit: unix.Rlimit{Cur: 1024, Max: 4096}},
+				{resource: unix.RLIMIT_CORE, limit: unix.Rlimit{Cur: 0, Max: 0}},
+			},
+		},
+		{
+			name:   "unknown limit",
+			limits: []string{"bogus=1"},
+			err:    true,
+		},
+		{
+			name:   "missing value",
+			limits: []string{"nofile"},
+			err:    true,
+		},
+		{
+			name:   "malformed soft limit",
+			limits: []string{"nofile=lots"},
+			err:    true,
+		},
+		{
+			name:   "malformed hard limit",
+			limits: []string{"nofile=1024:lots"},
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits, err := parseRlimits(test.limits)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", limits)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(limits, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, limits)
+			}
+		})
+	}
+}
@@ -2,26 +2,64 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/concourse/flag"
+	"github.com/concourse/go-archive/tarfs"
 	"github.com/jessevdk/go-flags"
+	"github.com/opencontainers/runc/libcontainer/user"
+	"golang.org/x/sys/unix"
 )
 
+var signals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+}
+
 type Opts struct {
 	Logger flag.Lager
 
-	Sleep bool `long:"sleep"`
+	Sleep      bool     `long:"sleep"`
+	Supervise  bool     `long:"supervise"`
+	ReadyFile  string   `long:"ready-file"`
+	Chown      []string `long:"chown"`
+	CheckReady string   `long:"check-ready"`
+	Root       string   `long:"root"`
+
+	SignalAll    string `long:"signal-all" choice:"TERM" choice:"KILL"`
+	ListRunning  bool   `long:"list-running"`
+	ProcessesDir string `long:"processes-dir"`
+	StreamIn     string `long:"stream-in"`
+	StreamOut    string `long:"stream-out"`
+
+	ProcessDir   string `long:"process-dir"`
+	Detach       bool   `long:"detach"`
+	Attach       string `long:"attach"`
+	StdoutOffset int64  `long:"stdout-offset"`
+	StderrOffset int64  `long:"stderr-offset"`
+	Signal       string `long:"signal" choice:"TERM" choice:"KILL"`
+	Resize       string `long:"resize"`
+	Remove       bool   `long:"remove"`
+
+	TTY        bool   `long:"tty"`
+	WindowSize string `long:"window-size"`
+
+	Dir              string   `long:"dir"`
+	Env              []string `long:"env"`
+	EnvFile          string   `long:"env-file"`
+	User             string   `long:"user"`
+	Rlimits          []string `long:"rlimit"`
+	Umask            string   `long:"umask"`
+	DropCapabilities []string `long:"drop-capability"`
 
-	Dir  string   `long:"dir"`
-	Env  []string `long:"env"`
-	User string   `long:"user"`
+	WriteEnvFile string `long:"write-env-file"`
 }
 
 func main() {
@@ -39,59 +77,366 @@ func main() {
 
 	logger, _ := opts.constructLogger()
 
+	if opts.CheckReady != "" {
+		if !isReady(opts.CheckReady) {
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	if opts.Sleep {
+		if opts.Root != "" {
+			err := prepareRoot(opts.Root)
+			if err != nil {
+				logger.Fatal("prepare-root-failed", err)
+			}
+		}
+
+		// the user only matters here for handing directories over to it
+		if len(opts.Chown) > 0 && opts.User != "" {
+			execUser, err := lookupUser(opts.User, opts.Root)
+			if err != nil {
+				logger.Fatal("lookup-user", err, lager.Data{"user": opts.User})
+			}
+
+			for _, dir := range opts.Chown {
+				err := chownTree(filepath.Join("/", opts.Root, dir), execUser)
+				if err != nil {
+					logger.Fatal("chown-failed", err, lager.Data{"dir": dir})
+				}
+			}
+		}
+
+		if opts.ReadyFile != "" {
+			err := markReady(opts.ReadyFile)
+			if err != nil {
+				logger.Fatal("mark-ready-failed", err)
+			}
+		}
+
 		exitSignal := make(chan os.Signal, 1)
 		signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
 
+		// as the container's pid 1, we inherit every process orphaned by the
+		// processes exec'd into it, and have to clean up after them
+		children := make(chan os.Signal, 1)
+		signal.Notify(children, syscall.SIGCHLD)
+
 		logger.Info("waiting-for-signal")
-		<-exitSignal
+		for signalled := false; !signalled; {
+			select {
+			case <-children:
+				reapChildren(0)
+
+			case <-exitSignal:
+				signalled = true
+			}
+		}
 
 		logger.Info("signal-received")
 		return
 	}
 
-	if len(args) == 0 {
-		logger.Fatal("no-command-given", nil)
+	// the file is read by a process' keeper, which stays outside of any root
+	if opts.WriteEnvFile != "" {
+		err := writeEnvFile(opts.WriteEnvFile, os.Stdin)
+		if err != nil {
+			logger.Fatal("write-env-file-failed", err)
+		}
+
+		return
 	}
 
-	program := args[0]
-	args[0], err = exec.LookPath(program)
+	if opts.SignalAll != "" {
+		if opts.ProcessesDir == "" {
+			logger.Fatal("no-processes-dir-given", nil)
+		}
 
-	if err != nil {
-		logger.Fatal("could-not-resolve-executable", err, lager.Data{
-			"program": program,
-		})
+		err := signalAll(opts.ProcessesDir, opts.SignalAll)
+		if err != nil {
+			logger.Fatal("signal-all-failed", err)
+		}
+
+		return
+	}
+
+	if opts.ListRunning {
+		if opts.ProcessesDir == "" {
+			logger.Fatal("no-processes-dir-given", nil)
+		}
+
+		running, err := runningProcesses(opts.ProcessesDir)
+		if err != nil {
+			logger.Fatal("list-running-failed", err)
+		}
+
+		for _, name := range running {
+			fmt.Println(name)
+		}
+
+		return
+	}
+
+	if opts.Attach != "" {
+		status, err := attach(opts.Attach, os.Stdout, os.Stderr, opts.StdoutOffset, opts.StderrOffset)
+		if err != nil {
+			logger.Fatal("attach-failed", err)
+		}
+
+		os.Exit(status)
+	}
+
+	if opts.ProcessDir != "" && opts.Remove {
+		err := removeProcess(opts.ProcessDir)
+		if err != nil {
+			logger.Fatal("remove-failed", err)
+		}
+
+		return
+	}
+
+	if opts.ProcessDir != "" && (opts.Signal != "" || opts.Resize != "") {
+		request := []string{"signal", opts.Signal}
+		if opts.Resize != "" {
+			request = []string{"resize", opts.Resize}
+		}
+
+		err := sendControl(opts.ProcessDir, request...)
+		if err != nil {
+			logger.Fatal("control-failed", err)
+		}
+
+		return
+	}
+
+	if opts.ProcessDir != "" && opts.Detach {
+		status, err := detach(opts.ProcessDir, os.Stdin, os.Stdout, os.Stderr)
+		if err != nil {
+			logger.Fatal("detach-failed", err)
+		}
+
+		os.Exit(status)
+	}
+
+	// a process keeper has to stay outside of the root, alongside its
+	// process' directory, and leaves everything else to the init it runs the
+	// process through
+	if opts.ProcessDir != "" {
+		if len(args) == 0 {
+			logger.Fatal("no-command-given", nil)
+		}
+
+		// the keeper is the last to need the file, and it likely holds
+		// credentials, so shouldn't be left lying around
+		if opts.EnvFile != "" {
+			fileVars, err := readEnvFile(opts.EnvFile)
+			if err != nil {
+				logger.Fatal("read-env-file", err, lager.Data{"path": opts.EnvFile})
+			}
+
+			if err := os.Remove(opts.EnvFile); err != nil {
+				logger.Fatal("remove-env-file", err, lager.Data{"path": opts.EnvFile})
+			}
+
+			opts.Env = append(fileVars, opts.Env...)
+			opts.EnvFile = ""
+		}
+
+		var windowSize *unix.Winsize
+		if opts.TTY {
+			windowSize = &unix.Winsize{}
+			if opts.WindowSize != "" {
+				windowSize, err = parseWindowSize(opts.WindowSize)
+				if err != nil {
+					logger.Fatal("parse-window-size", err)
+				}
+			}
+		}
+
+		cmd, err := processCommand(opts, args)
+		if err != nil {
+			logger.Fatal("process-command-failed", err)
+		}
+
+		err = keepProcess(opts.ProcessDir, cmd, windowSize)
+		if err != nil {
+			logger.Fatal("keep-process-failed", err)
+		}
+
+		return
 	}
 
+	// rather than being replaced by the process, stay around as its parent,
+	// reaping anything it orphans and passing signals on to its group, so the
+	// process can be run as a container's pid 1
+	if opts.Supervise {
+		if len(args) == 0 {
+			logger.Fatal("no-command-given", nil)
+		}
+
+		cmd, err := processCommand(opts, args)
+		if err != nil {
+			logger.Fatal("process-command-failed", err)
+		}
+
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		status, err := supervise(cmd, nil)
+		if err != nil {
+			logger.Fatal("supervise-failed", err)
+		}
+
+		os.Exit(status)
+	}
+
+	if opts.Root != "" {
+		err := enterRoot(opts.Root)
+		if err != nil {
+			logger.Fatal("enter-root-failed", err, lager.Data{"root": opts.Root})
+		}
+	}
+
+	var execUser *user.ExecUser
 	if opts.User != "" {
-		u, err := user.Lookup(opts.User)
+		execUser, err = lookupUser(opts.User, "")
+		if err != nil {
+			logger.Fatal("lookup-user", err, lager.Data{"user": opts.User})
+		}
+	}
+
+	if opts.StreamIn != "" {
+		becomeUser(logger, execUser)
+
+		err := tarfs.Extract(os.Stdin, opts.StreamIn)
 		if err != nil {
-			logger.Fatal("lookup-user", err)
+			logger.Fatal("stream-in-failed", err)
 		}
 
-		uid, err := strconv.Atoi(u.Uid)
+		return
+	}
+
+	if opts.StreamOut != "" {
+		becomeUser(logger, execUser)
+
+		err := streamOut(os.Stdout, opts.StreamOut)
 		if err != nil {
-			logger.Fatal("parse-uid", err)
+			logger.Fatal("stream-out-failed", err)
 		}
 
-		err = syscall.Setuid(uid)
+		return
+	}
+
+	if len(args) == 0 {
+		logger.Fatal("no-command-given", nil)
+	}
+
+	// like guardian, processes start in their user's home directory unless
+	// told otherwise
+	dir := opts.Dir
+	if dir == "" && execUser != nil {
+		dir = execUser.Home
+	}
+
+	if dir != "" {
+		err := prepareDir(filepath.Join("/", dir), execUser)
 		if err != nil {
-			logger.Fatal("set-uid", err)
+			logger.Fatal("prepare-dir", err, lager.Data{"dir": dir})
 		}
 	}
 
-	if opts.Dir != "" {
-		err := syscall.Chdir(opts.Dir)
+	// variables given on the command line take precedence over the file's
+	vars := opts.Env
+	if opts.EnvFile != "" {
+		fileVars, err := readEnvFile(opts.EnvFile)
+		if err != nil {
+			logger.Fatal("read-env-file", err, lager.Data{"path": opts.EnvFile})
+		}
+
+		vars = append(fileVars, opts.Env...)
+	}
+
+	rlimits, err := parseRlimits(opts.Rlimits)
+	if err != nil {
+		logger.Fatal("parse-rlimits", err)
+	}
+
+	env := processEnv(execUser, vars)
+	for _, e := range env {
+		// resolve the program with the PATH it'll run with, not our own
+		if strings.HasPrefix(e, "PATH=") {
+			os.Setenv("PATH", strings.TrimPrefix(e, "PATH="))
+		}
+	}
+
+	program := args[0]
+	args[0], err = exec.LookPath(program)
+	if err != nil {
+		logger.Fatal("could-not-resolve-executable", err, lager.Data{
+			"program": program,
+		})
+	}
+
+	if dir != "" {
+		err := syscall.Chdir(dir)
 		if err != nil {
 			logger.Fatal("chdir", err)
 		}
 	}
 
-	err = syscall.Exec(args[0], args, append(os.Environ(), opts.Env...))
+	if opts.Umask != "" {
+		if err := setUmask(opts.Umask); err != nil {
+			logger.Fatal("set-umask", err)
+		}
+	}
+
+	// raising hard limits needs root, so they're set before switching user
+	if err := setRlimits(rlimits); err != nil {
+		logger.Fatal("set-rlimits", err)
+	}
+
+	if err := dropCapabilities(opts.DropCapabilities); err != nil {
+		logger.Fatal("drop-capabilities", err)
+	}
+
+	becomeUser(logger, execUser)
+
+	err = syscall.Exec(args[0], args, env)
 	logger.Fatal("exec-failed", err)
 }
 
+func becomeUser(logger lager.Logger, execUser *user.ExecUser) {
+	if execUser == nil {
+		return
+	}
+
+	err := switchUser(execUser)
+	if err != nil {
+		logger.Fatal("switch-user", err, lager.Data{
+			"uid": execUser.Uid,
+			"gid": execUser.Gid,
+		})
+	}
+}
+
+// streamOut writes a tar stream of the given path, following garden's
+// convention of only including a directory's contents when the path has a
+// trailing slash
+func streamOut(dest io.Writer, path string) error {
+	if strings.HasSuffix(path, "/") {
+		return tarfs.Compress(dest, path, ".")
+	}
+
+	return tarfs.Compress(dest, filepath.Dir(path), filepath.Base(path))
+}
+
 func (cmd *Opts) constructLogger() (lager.Logger, *lager.ReconfigurableSink) {
+	// stdout belongs to the process being run (or the tar stream being
+	// written), so keep logs out of it
+	cmd.Logger.SetWriterSink(os.Stderr)
+
 	logger, reconfigurableSink := cmd.Logger.Logger("init")
 	return logger, reconfigurableSink
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxOutputSegmentSize is how big each of the files a process' output is
+// written to gets, before moving on to a new one. Only the latest two are kept
+// around, which bounds how much space a chatty process uses, while leaving
+// plenty of its output for anyone attaching to it later.
+const maxOutputSegmentSize = 8 * 1024 * 1024
+
+// outputSegment is the name of the file holding a stream's output from the
+// given offset, counted from the start of the stream
+func outputSegment(dir, name string, offset int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%d", name, offset))
+}
+
+// createOutput creates the first file of an output stream, so there's
+// something to attach to before the process has written anything
+func createOutput(dir, name string) error {
+	return touchFile(outputSegment(dir, name, 0))
+}
+
+// outputSegments finds the offsets of a stream's files, in order
+func outputSegments(dir, name string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := []int64{}
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), name+".")
+		if suffix == entry.Name() {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		offsets = append(offsets, offset)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	return offsets, nil
+}
+
+// outputWriter writes a stream of output across a series of files, moving on
+// to a new file whenever one fills up, and removing the oldest
+type outputWriter struct {
+	mu sync.Mutex
+
+	dir  string
+	name string
+
+	file     *os.File
+	offset   int64
+	size     int64
+	previous int64
+}
+
+func openOutputWriter(dir, name string) (*outputWriter, error) {
+	offsets, err := outputSegments(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("no %s to write to in '%s'", name, dir)
+	}
+
+	writer := &outputWriter{
+		dir:      dir,
+		name:     name,
+		offset:   offsets[len(offsets)-1],
+		previous: -1,
+	}
+
+	writer.file, err = os.OpenFile(outputSegment(dir, name, writer.offset), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := writer.file.Stat()
+	if err != nil {
+		writer.file.Close()
+		return nil, err
+	}
+
+	writer.size = info.Size()
+
+	return writer, nil
+}
+
+func (w *outputWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	written := 0
+	for written < len(data) {
+		if w.size >= maxOutputSegmentSize {
+			if err := w.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := data[written:]
+		if space := maxOutputSegmentSize - w.size; int64(len(chunk)) > space {
+			chunk = chunk[:space]
+		}
+
+		n, err := w.file.Write(chunk)
+		written += n
+		w.size += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// rotate moves on to a new file. Anyone reading the old one can still finish
+// reading it once it's removed, and knows it's complete once the new one
+// exists.
+func (w *outputWriter) rotate() error {
+	next := w.offset + w.size
+
+	file, err := os.OpenFile(outputSegment(w.dir, w.name, next), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.file.Close()
+
+	if w.previous >= 0 {
+		err := os.Remove(outputSegment(w.dir, w.name, w.previous))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			file.Close()
+			return err
+		}
+	}
+
+	w.file, w.previous, w.offset, w.size = file, w.offset, next, 0
+
+	return nil
+}
+
+func (w *outputWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
+
+// outputReader follows a stream of output from one file to the next
+type outputReader struct {
+	dir  string
+	name string
+
+	file    *os.File
+	segment int64
+}
+
+// openOutputReader opens a stream of output from the given offset. Anything
+// from before the oldest file still around is skipped.
+func openOutputReader(dir, name string, offset int64) (*outputReader, error) {
+	for {
+		offsets, err := outputSegments(dir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(offsets) == 0 {
+			return nil, fmt.Errorf("no %s to read in '%s'", name, dir)
+		}
+
+		segment := offsets[0]
+		for _, o := range offsets {
+			if o <= offset {
+				segment = o
+			}
+		}
+
+		file, err := os.Open(outputSegment(dir, name, segment))
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since we looked, so look again
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if offset > segment {
+			if _, err := file.Seek(offset-segment, io.SeekStart); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+
+		return &outputReader{
+			dir:  dir,
+			name: name,
+
+			file:    file,
+			segment: segment,
+		}, nil
+	}
+}
+
+// copyTo copies everything written so far to the given writer
+func (r *outputReader) copyTo(writer io.Writer) error {
+	for {
+		if _, err := io.Copy(writer, r.file); err != nil {
+			return err
+		}
+
+		offsets, err := outputSegments(r.dir, r.name)
+		if err != nil {
+			return err
+		}
+
+		next := int64(-1)
+		for _, o := range offsets {
+			if o > r.segment {
+				next = o
+				break
+			}
+		}
+
+		if next < 0 {
+			return nil
+		}
+
+		// the writer has moved on from the file we're reading, so anything
+		// left in it has been written by now
+		if _, err := io.Copy(writer, r.file); err != nil {
+			return err
+		}
+
+		file, err := os.Open(outputSegment(r.dir, r.name, next))
+		if errors.Is(err, os.ErrNotExist) {
+			// we fell far enough behind for it to be removed already, and
+			// will skip ahead to whatever's left
+			r.segment = next
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		r.file.Close()
+		r.file, r.segment = file, next
+	}
+}
+
+func (r *outputReader) Close() error {
+	return r.file.Close()
+}
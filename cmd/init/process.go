@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// files kept in a detached process' directory, which outlive any exec
+// session attached to the process
+const (
+	pidFile        = "pid"
+	keeperPidFile  = "keeper"
+	exitStatusFile = "exitcode"
+	stdinFifo      = "stdin"
+	stdoutFile     = "stdout"
+	stderrFile     = "stderr"
+
+	attachPollInterval = 100 * time.Millisecond
+	outputDrainTimeout = 1 * time.Second
+
+	// reported when the process couldn't be started at all
+	failedExitStatus = 255
+
+	// reported when the keeper went away without recording the process'
+	// exit status, most likely having been killed along with it
+	lostExitStatus = 128 + int(syscall.SIGKILL)
+)
+
+// detach prepares a process directory, and starts this command again in its
+// own session to keep the process running there, independent of the exec
+// session we belong to. It then attaches to the process, feeding it our stdin
+// and copying its output to ours, until it exits.
+func detach(dir string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return 0, err
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if os.IsExist(err) {
+			return 0, fmt.Errorf("process directory '%s' already exists", dir)
+		}
+
+		return 0, err
+	}
+
+	for _, fifo := range []string{stdinFifo, controlFifo} {
+		if err := unix.Mkfifo(filepath.Join(dir, fifo), 0600); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, output := range []string{stdoutFile, stderrFile} {
+		if err := createOutput(dir, output); err != nil {
+			return 0, err
+		}
+	}
+
+	// anything the keeper has to say about failing to run the process is
+	// most useful alongside the process' own errors
+	keeperStderr, err := os.OpenFile(outputSegment(dir, stderrFile, 0), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer keeperStderr.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	keeper := exec.Command(self)
+	keeper.Args = withoutArg(os.Args, "--detach")
+	keeper.Stderr = keeperStderr
+	keeper.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+
+	if err := keeper.Start(); err != nil {
+		return 0, err
+	}
+
+	keeperExited := make(chan error, 1)
+	go func() {
+		keeperExited <- keeper.Wait()
+	}()
+
+	// opening the fifo blocks until the keeper opens the other end, which it
+	// may never do if it fails first
+	fifoOpened := make(chan *os.File, 1)
+	go func() {
+		fifo, err := os.OpenFile(filepath.Join(dir, stdinFifo), os.O_WRONLY, 0)
+		if err == nil {
+			fifoOpened <- fifo
+		}
+	}()
+
+	select {
+	case fifo := <-fifoOpened:
+		go func() {
+			_, _ = io.Copy(fifo, stdin)
+			fifo.Close()
+		}()
+
+	case err := <-keeperExited:
+		_ = writeStateFile(dir, exitStatusFile, strconv.Itoa(failedExitStatus))
+		return 0, fmt.Errorf("process keeper exited before starting the process: %v", err)
+	}
+
+	return attach(dir, stdout, stderr, 0, 0)
+}
+
+// processCommand has init run a process as a child of ours, setting the
+// process up (its root, user, environment, limits and capabilities) and then
+// exec'ing it.
+// The process keeps the child's pid, and nothing applied on the way applies
+// to us.
+func processCommand(opts *Opts, args []string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	initArgs := []string{}
+	for _, flag := range []struct{ name, value string }{
+		{"--root", opts.Root},
+		{"--dir", opts.Dir},
+		{"--user", opts.User},
+		{"--umask", opts.Umask},
+		{"--env-file", opts.EnvFile},
+	} {
+		if flag.value != "" {
+			initArgs = append(initArgs, flag.name, flag.value)
+		}
+	}
+
+	for _, env := range opts.Env {
+		initArgs = append(initArgs, "--env", env)
+	}
+
+	for _, limit := range opts.Rlimits {
+		initArgs = append(initArgs, "--rlimit", limit)
+	}
+
+	for _, capability := range opts.DropCapabilities {
+		initArgs = append(initArgs, "--drop-capability", capability)
+	}
+
+	initArgs = append(initArgs, "--")
+	initArgs = append(initArgs, args...)
+
+	return exec.Command(self, initArgs...), nil
+}
+
+// keepProcess runs a process with its stdio connected to the files in its
+// directory, recording its pid and, eventually, its exit status there. If
+// given a window size, the process is run in a new tty instead. Its output is
+// copied through us, so the files it's written to can be kept to a size.
+func keepProcess(dir string, cmd *exec.Cmd, windowSize *unix.Winsize) error {
+	// anyone attaching needs to know if we've gone, as there'd be no exit
+	// status coming
+	if err := writeStateFile(dir, keeperPidFile, strconv.Itoa(os.Getpid())); err != nil {
+		return err
+	}
+
+	stdin, err := os.Open(filepath.Join(dir, stdinFifo))
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+
+	stdout, err := openOutputWriter(dir, stdoutFile)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+
+	stderr, err := openOutputWriter(dir, stderrFile)
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+
+	// opened for writing too, so it doesn't hit EOF each time a writer goes
+	// away
+	control, err := os.OpenFile(filepath.Join(dir, controlFifo), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	var tty, ttySlave *os.File
+	var processEnds []*os.File
+	outputDone := make(chan struct{})
+
+	if windowSize == nil {
+		stdoutReader, stdoutWriter, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer stdoutReader.Close()
+		defer stdoutWriter.Close()
+
+		stderrReader, stderrWriter, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer stderrReader.Close()
+		defer stderrWriter.Close()
+
+		cmd.Stdin = stdin
+		cmd.Stdout = stdoutWriter
+		cmd.Stderr = stderrWriter
+		processEnds = []*os.File{stdoutWriter, stderrWriter}
+
+		stdoutDone := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(stdout, stdoutReader)
+			close(stdoutDone)
+		}()
+
+		go func() {
+			// copying finishes once nothing has the pipes open anymore
+			_, _ = io.Copy(stderr, stderrReader)
+			<-stdoutDone
+			close(outputDone)
+		}()
+	} else {
+		tty, ttySlave, err = openPTY()
+		if err != nil {
+			return err
+		}
+		defer tty.Close()
+		defer ttySlave.Close()
+
+		if err := unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, windowSize); err != nil {
+			return err
+		}
+
+		cmd.Stdin = ttySlave
+		cmd.Stdout = ttySlave
+		cmd.Stderr = ttySlave
+		processEnds = []*os.File{ttySlave}
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+
+		go func() {
+			_, _ = io.Copy(tty, stdin)
+		}()
+
+		go func() {
+			// reading fails once nothing has the tty open anymore
+			_, _ = io.Copy(stdout, tty)
+			close(outputDone)
+		}()
+	}
+
+	status, err := supervise(cmd, func(pid int) error {
+		// only the process should be keeping its output open, so we see when
+		// it's done with it
+		for _, end := range processEnds {
+			end.Close()
+		}
+
+		go handleControl(control, pid, tty)
+
+		return writeStateFile(dir, pidFile, strconv.Itoa(pid))
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to run process: %s\n", err)
+		status = failedExitStatus
+
+		for _, end := range processEnds {
+			end.Close()
+		}
+	}
+
+	// anything the process left running in the background could hold its
+	// output open indefinitely, so only wait a moment for the rest of it
+	select {
+	case <-outputDone:
+	case <-time.After(outputDrainTimeout):
+	}
+
+	return writeStateFile(dir, exitStatusFile, strconv.Itoa(status))
+}
+
+// attach copies a detached process' output, from the given offsets, until it
+// exits. Returns the process' exit status.
+func attach(dir string, stdout, stderr io.Writer, stdoutOffset, stderrOffset int64) (int, error) {
+	// signals meant for the process (eg. from stopping the container) also
+	// reach us, and shouldn't cut its output short
+	signal.Notify(make(chan os.Signal, 1), forwardedSignals...)
+
+	outputs := map[string]io.Writer{
+		stdoutFile: stdout,
+		stderrFile: stderr,
+	}
+
+	offsets := map[string]int64{
+		stdoutFile: stdoutOffset,
+		stderrFile: stderrOffset,
+	}
+
+	readers := map[string]*outputReader{}
+	for name := range outputs {
+		reader, err := openOutputReader(dir, name, offsets[name])
+		if err != nil {
+			return 0, err
+		}
+		defer reader.Close()
+
+		readers[name] = reader
+	}
+
+	for {
+		// check for an exit status before copying, so we're sure to have
+		// copied everything written before the process exited
+		status, exited, err := readExitStatus(dir)
+		if err != nil {
+			return 0, err
+		}
+
+		for name, writer := range outputs {
+			if err := readers[name].copyTo(writer); err != nil {
+				return 0, err
+			}
+		}
+
+		if exited {
+			return status, nil
+		}
+
+		if !keeperAlive(dir) {
+			// the keeper may have recorded an exit status just before
+			// exiting, and otherwise never will
+			status, exited, err := readExitStatus(dir)
+			if err != nil {
+				return 0, err
+			}
+
+			if !exited {
+				status = lostExitStatus
+				fmt.Fprintln(stderr, "process keeper exited without recording an exit status")
+				_ = writeStateFile(dir, exitStatusFile, strconv.Itoa(status))
+			}
+
+			for name, writer := range outputs {
+				if err := readers[name].copyTo(writer); err != nil {
+					return 0, err
+				}
+			}
+
+			return status, nil
+		}
+
+		time.Sleep(attachPollInterval)
+	}
+}
+
+// keeperAlive checks on the keeper of a detached process. A keeper which
+// hasn't recorded its pid yet is assumed to still be starting.
+func keeperAlive(dir string) bool {
+	contents, err := os.ReadFile(filepath.Join(dir, keeperPidFile))
+	if err != nil {
+		return true
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return true
+	}
+
+	// a keeper is reaped straight away by the init which started it, or once
+	// that's gone, by the container's init, so never lingers as a zombie
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// runningProcesses finds the detached processes which are still running,
+// by the names of their directories. A process whose keeper has gone without
+// recording its exit status has its exit status recorded as lost, as anyone
+// attaching to it would.
+func runningProcesses(processesDir string) ([]string, error) {
+	entries, err := os.ReadDir(processesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	running := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(processesDir, entry.Name())
+
+		_, exited, err := readExitStatus(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if exited {
+			continue
+		}
+
+		if !keeperAlive(dir) {
+			// the keeper may have recorded an exit status just before
+			// exiting, and otherwise never will
+			if _, exited, _ := readExitStatus(dir); !exited {
+				_ = writeStateFile(dir, exitStatusFile, strconv.Itoa(lostExitStatus))
+			}
+
+			continue
+		}
+
+		running = append(running, entry.Name())
+	}
+
+	return running, nil
+}
+
+// removeProcess cleans up after a detached process, once its exit status has
+// been recorded somewhere else. A process which is still running is left
+// alone.
+func removeProcess(dir string) error {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	_, exited, err := readExitStatus(dir)
+	if err != nil {
+		return err
+	}
+
+	if !exited {
+		return errors.New("process is still running")
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func readExitStatus(dir string) (int, bool, error) {
+	contents, err := os.ReadFile(filepath.Join(dir, exitStatusFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	status, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed exit status: %w", err)
+	}
+
+	return status, true, nil
+}
+
+// writeStateFile replaces a file in a process directory in one go, so anyone
+// reading it never sees it half written
+func writeStateFile(dir, name, contents string) error {
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, []byte(contents+"\n"), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+func touchFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// withoutArg removes the first occurrence of a flag from a command line,
+// leaving anything after "--" alone
+func withoutArg(args []string, arg string) []string {
+	stripped := make([]string, 0, len(args))
+	for i, a := range args {
+		if a == "--" {
+			return append(stripped, args[i:]...)
+		}
+
+		if a == arg {
+			return append(stripped, args[i+1:]...)
+		}
+
+		stripped = append(stripped, a)
+	}
+
+	return stripped
+}
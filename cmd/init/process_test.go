@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestWithoutArg(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		arg      string
+		expected []string
+	}{
+		{
+			name:     "removes the flag",
+			args:     []string{"init", "--process-dir", "dir", "--detach", "--", "echo"},
+			arg:      "--detach",
+			expected: []string{"init", "--process-dir", "dir", "--", "echo"},
+		},
+		{
+			name:     "only removes the first occurrence",
+			args:     []string{"init", "--detach", "--detach"},
+			arg:      "--detach",
+			expected: []string{"init", "--detach"},
+		},
+		{
+			name:     "leaves the command alone",
+			args:     []string{"init", "--process-dir", "dir", "--", "echo", "--detach"},
+			arg:      "--detach",
+			expected: []string{"init", "--process-dir", "dir", "--", "echo", "--detach"},
+		},
+		{
+			name:     "without the flag",
+			args:     []string{"init", "--process-dir", "dir"},
+			arg:      "--detach",
+			expected: []string{"init", "--process-dir", "dir"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := withoutArg(test.args, test.arg)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestProcessCommand(t *testing.T) {
+	opts := &Opts{
+		Root:    "/root",
+		Dir:     "/dir",
+		User:    "user",
+		Umask:   "022",
+		Env:     []string{"A=1", "B=2"},
+		Rlimits: []string{"nofile=1024"},
+
+		DropCapabilities: []string{"SYS_ADMIN"},
+	}
+
+	cmd, err := processCommand(opts, []string{"echo", "--dir", "not-a-flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the process' init has to end up with the same options as its keeper
+	parsed := &Opts{}
+	args, err := flags.NewParser(parsed, flags.Default).ParseArgs(cmd.Args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed.Logger = opts.Logger
+	if !reflect.DeepEqual(parsed, opts) {
+		t.Errorf("expected %+v, got %+v", opts, parsed)
+	}
+
+	if expected := []string{"echo", "--dir", "not-a-flag"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected args %v, got %v", expected, args)
+	}
+}
+
+func TestOutputRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := createOutput(dir, stdoutFile); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := openOutputWriter(dir, stdoutFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	// a reader following along from the start, and falling behind
+	following, err := openOutputReader(dir, stdoutFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer following.Close()
+
+	written := new(bytes.Buffer)
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	for i := 0; written.Len() < 3*maxOutputSegmentSize; i++ {
+		chunk[0] = byte(i)
+		if _, err := writer.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		written.Write(chunk)
+	}
+
+	offsets, err := outputSegments(dir, stdoutFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(offsets) != 2 {
+		t.Errorf("expected 2 files to be kept, got %v", offsets)
+	}
+
+	// a reader which only holds on to the oldest file gets the start of the
+	// output, and then whatever's left
+	followed := new(bytes.Buffer)
+	if err := following.copyTo(followed); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(followed.Bytes(), written.Bytes()[:maxOutputSegmentSize]) {
+		t.Errorf("expected the start of the output to be read")
+	}
+
+	if !bytes.HasSuffix(followed.Bytes(), written.Bytes()[offsets[0]:]) {
+		t.Errorf("expected the rest of the kept output to be read")
+	}
+
+	// a reader starting part way through the kept output picks up from there
+	offset := offsets[0] + 100
+	resumed, err := openOutputReader(dir, stdoutFile, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	output := new(bytes.Buffer)
+	if err := resumed.copyTo(output); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output.Bytes(), written.Bytes()[offset:]) {
+		t.Errorf("expected output from offset %d, got %d bytes", offset, output.Len())
+	}
+
+	// and one starting before the kept output gets everything kept
+	skipped, err := openOutputReader(dir, stdoutFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skipped.Close()
+
+	output.Reset()
+	if err := skipped.copyTo(output); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output.Bytes(), written.Bytes()[offsets[0]:]) {
+		t.Errorf("expected output from offset %d, got %d bytes", offsets[0], output.Len())
+	}
+}
+
+func TestRunningProcesses(t *testing.T) {
+	processesDir := t.TempDir()
+
+	// a pid which is no longer in use, for a keeper which has gone
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	states := map[string]map[string]string{
+		"exited":   {keeperPidFile: strconv.Itoa(os.Getpid()), exitStatusFile: "0"},
+		"running":  {keeperPidFile: strconv.Itoa(os.Getpid())},
+		"starting": {},
+		"lost":     {keeperPidFile: strconv.Itoa(gone.Process.Pid)},
+	}
+
+	for name, files := range states {
+		dir := filepath.Join(processesDir, name)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		for file, contents := range files {
+			if err := writeStateFile(dir, file, contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	running, err := runningProcesses(processesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"running", "starting"}; !reflect.DeepEqual(running, expected) {
+		t.Errorf("expected %v, got %v", expected, running)
+	}
+
+	status, exited, err := readExitStatus(filepath.Join(processesDir, "lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exited || status != lostExitStatus {
+		t.Errorf("expected lost process to have exited with %d, got %d (exited: %v)", lostExitStatus, status, exited)
+	}
+}
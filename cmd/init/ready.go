@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+// chownTree hands a directory, and everything in it, over to a user. Volumes
+// are owned by root when mounted, leaving a non-root user unable to write to
+// them otherwise.
+func chownTree(dir string, execUser *user.ExecUser) error {
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		return os.Lchown(path, execUser.Uid, execUser.Gid)
+	})
+}
+
+// markReady records that the container has finished starting, once anything
+// which had to happen first has been done
+func markReady(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return touchFile(path)
+}
+
+// isReady checks for the marker left by markReady
+func isReady(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// files the container runtime sets up for the container, which a rootfs
+// volume has no way of getting otherwise
+var rootFiles = []string{
+	"/etc/hosts",
+	"/etc/hostname",
+	"/etc/resolv.conf",
+}
+
+// filesystems which processes in a rootfs volume expect to find, and which
+// can only be mounted into it with CAP_SYS_ADMIN
+var rootMounts = []string{
+	"/dev",
+	"/proc",
+	"/sys",
+}
+
+// prepareRoot sets a rootfs volume up for processes to be run in. Most images
+// are unusable without /dev, /proc and /sys, so failing to mount them fails
+// the container, rather than leaving it broken.
+func prepareRoot(root string) error {
+	for _, file := range rootFiles {
+		err := copyFile(file, filepath.Join(root, file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to copy '%s' into rootfs: %w", file, err)
+		}
+	}
+
+	for _, mount := range rootMounts {
+		target := filepath.Join(root, mount)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+
+		err := unix.Mount(mount, target, "", unix.MS_BIND|unix.MS_REC, "")
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			return fmt.Errorf("not permitted to mount '%s' into rootfs; the container needs CAP_SYS_ADMIN: %w", mount, err)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to mount '%s' into rootfs: %w", mount, err)
+		}
+	}
+
+	return nil
+}
+
+// enterRoot makes a rootfs volume our root directory, for anything not run
+// by a process keeper, which needs to stay where the process directories are
+func enterRoot(root string) error {
+	if err := syscall.Chroot(root); err != nil {
+		return err
+	}
+
+	return syscall.Chdir("/")
+}
+
+func copyFile(src, dest string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	// replace rather than write through whatever's there, which may be a
+	// symlink pointing outside of the root
+	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	destination, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+
+	return destination.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// signals which are passed on to a supervised process, rather than acted on
+// by init itself
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+// supervise runs a command as a child in its own process group, rather than
+// replacing init with it. Any signals init receives are forwarded to the
+// group, and any orphaned descendants are reaped, either as the container's
+// pid 1 or as a subreaper. Returns the command's exit status once it exits.
+func supervise(cmd *exec.Cmd, started func(pid int) error) (int, error) {
+	if os.Getpid() != 1 {
+		err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// subscribe before starting the child, so we can't miss it exiting
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+	defer signal.Stop(children)
+
+	forward := make(chan os.Signal, 16)
+	signal.Notify(forward, forwardedSignals...)
+	defer signal.Stop(forward)
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	// a process in a session of its own already leads its own group
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+
+		// an interactive process needs to own the terminal, or it will be
+		// stopped as soon as it tries to read from it
+		if stdin, ok := cmd.Stdin.(*os.File); ok && isTerminal(stdin) {
+			cmd.SysProcAttr.Foreground = true
+			cmd.SysProcAttr.Ctty = int(stdin.Fd())
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	pid := cmd.Process.Pid
+	if started != nil {
+		if err := started(pid); err != nil {
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+			return 0, err
+		}
+	}
+
+	for {
+		select {
+		case sig := <-forward:
+			// the group may have already exited, in which case the signal
+			// has nowhere to go
+			_ = syscall.Kill(-pid, sig.(syscall.Signal))
+
+		case <-children:
+			status, exited := reapChildren(pid)
+			if exited {
+				return exitStatus(status), nil
+			}
+		}
+	}
+}
+
+// reapChildren waits on every child which has exited, reporting the status
+// of the given pid if it was one of them
+func reapChildren(pid int) (syscall.WaitStatus, bool) {
+	var (
+		pidStatus syscall.WaitStatus
+		pidExited bool
+	)
+
+	for {
+		var status syscall.WaitStatus
+
+		reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil || reaped <= 0 {
+			return pidStatus, pidExited
+		}
+
+		if reaped == pid {
+			pidStatus, pidExited = status, true
+		}
+	}
+}
+
+// exitStatus follows the shell's convention of reporting death by signal as
+// 128 plus the signal number
+func exitStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
+}
+
+func isTerminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+// lookupUser resolves a garden user against the image's own passwd and group
+// files, in the same way guardian does. Users can be given as a name or uid,
+// optionally followed by a group name or gid (e.g. "user", "1000", "1000:1000"
+// or "user:group"). The files are looked for inside root, when given one.
+func lookupUser(spec, root string) (*user.ExecUser, error) {
+	passwdPath, err := user.GetPasswdPath()
+	if err != nil {
+		return nil, err
+	}
+
+	groupPath, err := user.GetGroupPath()
+	if err != nil {
+		return nil, err
+	}
+
+	passwdPath = filepath.Join("/", root, passwdPath)
+	groupPath = filepath.Join("/", root, groupPath)
+
+	defaults := &user.ExecUser{
+		Uid:  0,
+		Gid:  0,
+		Home: "/",
+	}
+
+	execUser, err := user.GetExecUserPath(spec, defaults, passwdPath, groupPath)
+	switch {
+	case errors.Is(err, user.ErrNoPasswdEntries):
+		return nil, fmt.Errorf("no user matching '%s' in the image's %s", spec, passwdPath)
+
+	case errors.Is(err, user.ErrNoGroupEntries):
+		return nil, fmt.Errorf("no group matching '%s' in the image's %s", spec, groupPath)
+
+	case err != nil:
+		return nil, fmt.Errorf("invalid user '%s': %w", spec, err)
+	}
+
+	return execUser, nil
+}
+
+// switchUser drops to the given user, along with their groups. The order
+// matters; once the uid has changed, we no longer have permission to change
+// groups, and would be left with root's.
+func switchUser(execUser *user.ExecUser) error {
+	if err := syscall.Setgroups(execUser.Sgids); err != nil {
+		return fmt.Errorf("failed to set supplementary groups %v: %w", execUser.Sgids, err)
+	}
+
+	if err := syscall.Setgid(execUser.Gid); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", execUser.Gid, err)
+	}
+
+	if err := syscall.Setuid(execUser.Uid); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", execUser.Uid, err)
+	}
+
+	return nil
+}
+
+// prepareDir creates a process' working directory if it doesn't exist yet,
+// giving it to the user the process runs as
+func prepareDir(dir string, execUser *user.ExecUser) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if execUser == nil {
+		return nil
+	}
+
+	return os.Lchown(dir, execUser.Uid, execUser.Gid)
+}
+
+// processEnv merges the environment a process should run with, where later
+// values take precedence over earlier ones
+func processEnv(execUser *user.ExecUser, env []string) []string {
+	merged := os.Environ()
+	if execUser != nil {
+		merged = append(merged, "HOME="+execUser.Home)
+	}
+
+	merged = append(merged, env...)
+
+	indexes := map[string]int{}
+	deduped := make([]string, 0, len(merged))
+
+	for _, e := range merged {
+		name := strings.SplitN(e, "=", 2)[0]
+		if i, found := indexes[name]; found {
+			deduped[i] = e
+			continue
+		}
+
+		indexes[name] = len(deduped)
+		deduped = append(deduped, e)
+	}
+
+	return deduped
+}
@@ -38,7 +38,7 @@ func LookupVolumeByPath(client baggageclaim.Client, path string) (baggageclaim.V
 			return vol, "", true, nil
 		}
 
-		if subPath, relative, err := isSubPath(vol.Path(), path); err == nil && subPath {
+		if subPath, relative, err := IsSubPath(vol.Path(), path); err == nil && subPath {
 			return vol, relative, true, nil
 		}
 	}
@@ -46,7 +46,9 @@ func LookupVolumeByPath(client baggageclaim.Client, path string) (baggageclaim.V
 	return nil, "", false, nil
 }
 
-func isSubPath(parent, sub string) (bool, string, error) {
+// IsSubPath reports whether sub is inside parent, along with its path
+// relative to parent
+func IsSubPath(parent, sub string) (bool, string, error) {
 	up := ".." + string(os.PathSeparator)
 
 	rel, err := filepath.Rel(parent, sub)
@@ -22,6 +22,7 @@ type BaggageClaimDriver struct {
 	config Config
 
 	client baggageclaim.Client
+	usage  *usageCache
 }
 
 type Config struct {
@@ -52,6 +53,7 @@ func NewBaggageClaimDriver(
 		config: cfg,
 
 		client: client,
+		usage:  newUsageCache(),
 	}, nil
 }
 
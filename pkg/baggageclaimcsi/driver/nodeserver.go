@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -15,7 +16,16 @@ import (
 )
 
 func (driver *BaggageClaimDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	caps := []*csi.NodeServiceCapability{}
+	caps := []*csi.NodeServiceCapability{
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+	}
+
 	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
@@ -154,8 +164,49 @@ func (driver *BaggageClaimDriver) NodeGetInfo(ctx context.Context, req *csi.Node
 	}, nil
 }
 
-func (driver *BaggageClaimDriver) NodeGetVolumeStats(ctx context.Context, in *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "UNIMPLEMENTED")
+func (driver *BaggageClaimDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+	volumePath := req.GetVolumePath()
+
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, "volume path does not exist")
+		}
+
+		return nil, fmt.Errorf("failed to check volume path: %w", err)
+	}
+
+	// volumes share the filesystem baggageclaim stores them on, so statfs can
+	// only tell us about capacity; usage has to be counted up by hand
+	var fsStat syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &fsStat); err != nil {
+		return nil, fmt.Errorf("failed to stat filesystem: %w", err)
+	}
+
+	usedBytes, usedInodes, err := driver.usage.usage(ctx, volumePath, info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate volume usage: %w", err)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(fsStat.Blocks) * fsStat.Bsize,
+				Available: int64(fsStat.Bavail) * fsStat.Bsize,
+				Used:      usedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(fsStat.Files),
+				Available: int64(fsStat.Ffree),
+				Used:      usedInodes,
+			},
+		},
+	}, nil
 }
 
 // NodeExpandVolume is only implemented so the driver can be used for e2e testing.
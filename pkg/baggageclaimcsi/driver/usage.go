@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// volumeUsageTTL is how long a volume's usage is reused for. The kubelet
+// asks for every mounted volume's stats on every stats period, and the same
+// volume is often mounted into several pods.
+const volumeUsageTTL = 1 * time.Minute
+
+type volumeUsage struct {
+	bytes  int64
+	inodes int64
+
+	measured time.Time
+}
+
+// volumeKey identifies the volume behind a mount point, which is the same
+// for every pod the volume is bind mounted into
+type volumeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// usageCache counts up the space used by volumes, which have to be walked as
+// they share a filesystem with every other volume
+type usageCache struct {
+	mu     sync.Mutex
+	usages map[volumeKey]volumeUsage
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{
+		usages: map[volumeKey]volumeUsage{},
+	}
+}
+
+// usage reports the bytes and inodes used by the volume mounted at the given
+// path, walking it only if it hasn't been recently
+func (c *usageCache) usage(ctx context.Context, path string, info os.FileInfo) (int64, int64, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return walkUsage(ctx, path)
+	}
+
+	key := volumeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+	now := time.Now()
+
+	c.mu.Lock()
+	cached, found := c.usages[key]
+	c.mu.Unlock()
+
+	if found && now.Sub(cached.measured) < volumeUsageTTL {
+		return cached.bytes, cached.inodes, nil
+	}
+
+	bytes, inodes, err := walkUsage(ctx, path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// volumes come and go, so forget about any which haven't been asked
+	// about in a while
+	for k, usage := range c.usages {
+		if now.Sub(usage.measured) >= volumeUsageTTL {
+			delete(c.usages, k)
+		}
+	}
+
+	c.usages[key] = volumeUsage{bytes: bytes, inodes: inodes, measured: now}
+
+	return bytes, inodes, nil
+}
+
+// walkUsage counts up the bytes and inodes used under a path, giving up if
+// the caller goes away. Files are often removed from a volume while it's in
+// use, which only means they no longer need counting.
+func walkUsage(ctx context.Context, path string) (int64, int64, error) {
+	var bytes, inodes int64
+
+	err := filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		bytes += info.Size()
+		inodes++
+
+		return nil
+	})
+
+	return bytes, inodes, err
+}
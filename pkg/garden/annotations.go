@@ -0,0 +1,62 @@
+package garden
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	// garden names (eg. the property "concourse:volumes") aren't always valid
+	// annotation names, so they're encoded using an alphabet which is safe to
+	// use in one
+	annotationEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+)
+
+func encodeAnnotationKey(prefix, name string) (string, error) {
+	encoded := strings.ToLower(annotationEncoding.EncodeToString([]byte(name)))
+	if len(encoded) > validation.DNS1123LabelMaxLength {
+		return "", fmt.Errorf("name '%s' is too long to store in an annotation", name)
+	}
+
+	return prefix + encoded, nil
+}
+
+func decodeAnnotationKey(prefix, key string) (string, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+
+	encoded := strings.ToUpper(strings.TrimPrefix(key, prefix))
+	name, err := annotationEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	return string(name), true
+}
+
+// patchAnnotations sets the given annotations on a pod, removing any whose
+// value is nil
+func (c Container) patchAnnotations(annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.CoreV1().
+		Pods(c.pod.Namespace).
+		Patch(context.Background(), c.pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+
+	return containerError(c.Handle(), err)
+}
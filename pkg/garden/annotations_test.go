@@ -0,0 +1,64 @@
+package garden
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestAnnotationKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		err  bool
+	}{
+		{name: "simple"},
+		{name: "concourse:volumes"},
+		{name: "with/slashes and spaces"},
+		{name: "UPPER and lower"},
+		{name: strings.Repeat("a", 39)},
+		{name: strings.Repeat("a", 40), err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := encodeAnnotationKey(propertyAnnotationPrefix, test.name)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", key)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				t.Errorf("expected a valid annotation key, got %s: %v", key, errs)
+			}
+
+			name, ok := decodeAnnotationKey(propertyAnnotationPrefix, key)
+			if !ok {
+				t.Fatalf("failed to decode %s", key)
+			}
+
+			if name != test.name {
+				t.Errorf("expected %q, got %q", test.name, name)
+			}
+		})
+	}
+}
+
+func TestDecodeAnnotationKeyIgnoresOtherKeys(t *testing.T) {
+	for _, key := range []string{
+		"some.other/annotation",
+		processAnnotationPrefix + "c5in6rr",
+		propertyAnnotationPrefix + "not base32!",
+	} {
+		if name, ok := decodeAnnotationKey(propertyAnnotationPrefix, key); ok {
+			t.Errorf("expected %s to be ignored, got %q", key, name)
+		}
+	}
+}
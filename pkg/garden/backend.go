@@ -7,18 +7,34 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/garden"
+	"github.com/concourse/concourse/worker/baggageclaim"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
 )
 
 var (
 	ErrUnsupported = errors.New("not supported")
 )
 
+const (
+	workerLabelKey = "atc.k8s.concourse-ci.org/worker"
+)
+
 type GardenBackend struct {
 	config Config
-	client *kubernetes.Clientset
+
+	client       *kubernetes.Clientset
+	restConfig   *rest.Config
+	baggageclaim baggageclaim.Client
+
+	pods      *podCache
+	health    *healthCheck
+	metrics   metricsCollector
+	processes *processTracker
 }
 
 type Config struct {
@@ -26,7 +42,23 @@ type Config struct {
 	BindAddress string
 
 	Namespace  string
+	NodeName   string
 	WorkerName string
+
+	CsiDriverName     string
+	DenyNetworkEgress bool
+	RawImageBase      string
+	PodStartTimeout   time.Duration
+	StopTimeout       time.Duration
+
+	CapacitySource string
+	MaxContainers  uint64
+
+	DefaultLimits garden.Limits
+	MaxLimits     garden.Limits
+
+	PingCacheDuration time.Duration
+	ReapInterval      time.Duration
 }
 
 var _ garden.Backend = &GardenBackend{}
@@ -34,88 +66,282 @@ var _ garden.Backend = &GardenBackend{}
 func NewGardenBackend(
 	cfg Config,
 	client *kubernetes.Clientset,
-) GardenBackend {
+	restConfig *rest.Config,
+	baggageclaimClient baggageclaim.Client,
+) (GardenBackend, error) {
+	metricsClient, err := metricsclient.NewForConfig(restConfig)
+	if err != nil {
+		return GardenBackend{}, err
+	}
+
 	return GardenBackend{
 		config: cfg,
-		client: client,
-	}
+
+		client:       client,
+		restConfig:   restConfig,
+		baggageclaim: baggageclaimClient,
+
+		metrics: metricsCollector{
+			config:  cfg,
+			client:  client,
+			metrics: metricsClient,
+		},
+		pods:      newPodCache(cfg, client),
+		health:    &healthCheck{},
+		processes: newProcessTracker(),
+	}, nil
 }
 
 func (backend *GardenBackend) Start() error {
+	backend.pods.start()
 	return nil
 }
 
 func (backend *GardenBackend) Stop() {
+	backend.pods.close()
 }
 
-func (backend *GardenBackend) GraceTime(container garden.Container) time.Duration {
-	return 0
-}
+func (backend *GardenBackend) Create(spec garden.ContainerSpec) (garden.Container, error) {
+	pod, err := backend.podForSpec(spec)
+	if err != nil {
+		return nil, err
+	}
 
-func (backend *GardenBackend) Ping() error {
-	return nil
-}
+	podClient := backend.client.CoreV1().Pods(backend.config.Namespace)
 
-func (backend *GardenBackend) Capacity() (garden.Capacity, error) {
-	return garden.Capacity{}, nil
+	created, err := podClient.Create(context.Background(), pod, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("handle '%s' already in use", spec.Handle)
+	}
+
+	// the cluster may not allow pods the capability init needs to set a raw
+	// image's rootfs up
+	if apierrors.IsForbidden(err) && len(droppedCapabilities(*pod)) > 0 {
+		return nil, fmt.Errorf("containers with a raw image need %s: %w", rootMountCapability, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ready *corev1.Pod
+
+	err = backend.restrictEgress(*created)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), backend.config.PodStartTimeout)
+		defer cancel()
+
+		ready, err = backend.waitForPodReady(ctx, created)
+	}
+
+	if err != nil {
+		// the pod will never be handed back to the atc, so don't leave it
+		// lying around for the sweeper to (maybe) find later.
+		deleteErr := podClient.Delete(context.Background(), created.Name, metav1.DeleteOptions{})
+		if deleteErr != nil && !apierrors.IsNotFound(deleteErr) {
+			return nil, fmt.Errorf("%w (and failed to clean up pod: %s)", err, deleteErr)
+		}
+
+		return nil, err
+	}
+
+	return backend.newContainer(*ready), nil
 }
 
-func (backend *GardenBackend) Create(spec garden.ContainerSpec) (garden.Container, error) {
-	return nil, ErrUnsupported
+// restrictEgress denies a new pod all egress when configured to, leaving it
+// to NetOut to allow any traffic
+func (backend *GardenBackend) restrictEgress(pod corev1.Pod) error {
+	if !backend.config.DenyNetworkEgress {
+		return nil
+	}
+
+	err := createNetworkPolicy(backend.client, pod, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create network policy: %w", err)
+	}
+
+	return nil
 }
 
 func (backend *GardenBackend) Destroy(handle string) error {
-	err := backend.client.CoreV1().
+	pod, err := backend.getPod(handle)
+	if err != nil {
+		return err
+	}
+
+	// the handle could have been reused since we looked the pod up, in which
+	// case the new pod isn't ours to delete
+	err = backend.client.CoreV1().
 		Pods(backend.config.Namespace).
-		Delete(context.Background(), handle, metav1.DeleteOptions{})
+		Delete(context.Background(), handle, metav1.DeleteOptions{
+			Preconditions: metav1.NewUIDPreconditions(string(pod.UID)),
+		})
 
-	if !apierrors.IsNotFound(err) {
-		return err
+	if err != nil {
+		return containerError(handle, err)
 	}
 
+	backend.processes.forget(handle)
 	return nil
 }
 
 func (backend *GardenBackend) Containers(filter garden.Properties) ([]garden.Container, error) {
-	selector := fmt.Sprintf("atc.k8s.concourse-ci.org/worker=%s", backend.config.WorkerName)
-	pods, err := backend.client.CoreV1().
-		Pods(backend.config.Namespace).
-		List(context.Background(), metav1.ListOptions{LabelSelector: selector})
-
+	pods, err := backend.listPods()
 	if err != nil {
 		return nil, err
 	}
 
-	containers := make([]garden.Container, 0, len(pods.Items))
-	for _, pod := range pods.Items {
-		containers = append(containers, Container{
-			pod:    pod,
-			client: backend.client,
-		})
+	containers := make([]garden.Container, 0, len(pods))
+	for _, pod := range pods {
+		if !matchesProperties(propertiesFromAnnotations(pod.Annotations), filter) {
+			continue
+		}
+
+		containers = append(containers, backend.newContainer(pod))
 	}
 
 	return containers, nil
 }
 
 func (backend *GardenBackend) BulkInfo(handles []string) (map[string]garden.ContainerInfoEntry, error) {
-	return nil, nil
+	pods, err := backend.listPods()
+	if err != nil {
+		return nil, err
+	}
+
+	podsByHandle := make(map[string]corev1.Pod, len(pods))
+	for _, pod := range pods {
+		podsByHandle[pod.Name] = pod
+	}
+
+	infos := make(map[string]garden.ContainerInfoEntry, len(handles))
+	for _, handle := range handles {
+		pod, found := podsByHandle[handle]
+		if !found {
+			infos[handle] = garden.ContainerInfoEntry{
+				Err: &garden.Error{Err: garden.ContainerNotFoundError{Handle: handle}},
+			}
+
+			continue
+		}
+
+		infos[handle] = garden.ContainerInfoEntry{
+			Info: infoForPod(pod),
+		}
+	}
+
+	return infos, nil
 }
 
 func (backend *GardenBackend) BulkMetrics(handles []string) (map[string]garden.ContainerMetricsEntry, error) {
-	return nil, nil
+	pods, err := backend.listPods()
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := backend.metrics.collect(pods)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]garden.ContainerMetricsEntry, len(handles))
+	for _, handle := range handles {
+		podMetrics, found := metrics[handle]
+		if !found {
+			entries[handle] = garden.ContainerMetricsEntry{
+				Err: &garden.Error{Err: garden.ContainerNotFoundError{Handle: handle}},
+			}
+
+			continue
+		}
+
+		entries[handle] = garden.ContainerMetricsEntry{
+			Metrics: podMetrics,
+		}
+	}
+
+	return entries, nil
 }
 
 func (backend *GardenBackend) Lookup(handle string) (garden.Container, error) {
+	pod, err := backend.getPod(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	return backend.newContainer(*pod), nil
+}
+
+// getPod finds the pod for a container belonging to this worker
+func (backend *GardenBackend) getPod(handle string) (*corev1.Pod, error) {
+	// a miss may just mean the cache hasn't seen a newly created pod yet, so
+	// only trust it when it has the pod
+	if backend.pods.synced() {
+		pod, found, err := backend.pods.get(backend.config, handle)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			return pod, nil
+		}
+	}
+
 	pod, err := backend.client.CoreV1().
 		Pods(backend.config.Namespace).
 		Get(context.Background(), handle, metav1.GetOptions{})
 
+	if err != nil {
+		return nil, containerError(handle, err)
+	}
+
+	// other workers can share the namespace, and their containers aren't
+	// ours to touch
+	if pod.Labels[workerLabelKey] != backend.config.WorkerName {
+		return nil, garden.ContainerNotFoundError{Handle: handle}
+	}
+
+	return pod, nil
+}
+
+// listPods lists the pods belonging to this worker
+func (backend *GardenBackend) listPods() ([]corev1.Pod, error) {
+	if backend.pods.synced() {
+		return backend.pods.list(backend.config)
+	}
+
+	selector := workerSelector(backend.config).String()
+	pods, err := backend.client.CoreV1().
+		Pods(backend.config.Namespace).
+		List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+
 	if err != nil {
 		return nil, err
 	}
 
+	return pods.Items, nil
+}
+
+// containerError translates errors from the api server about a container's
+// pod into the errors garden clients know how to handle
+func containerError(handle string, err error) error {
+	if apierrors.IsNotFound(err) {
+		return garden.ContainerNotFoundError{Handle: handle}
+	}
+
+	return err
+}
+
+func (backend *GardenBackend) newContainer(pod corev1.Pod) Container {
 	return Container{
-		pod:    *pod,
-		client: backend.client,
-	}, nil
+		config: backend.config,
+
+		client:       backend.client,
+		restConfig:   backend.restConfig,
+		baggageclaim: backend.baggageclaim,
+
+		pod:       pod,
+		metrics:   backend.metrics,
+		processes: backend.processes,
+	}
 }
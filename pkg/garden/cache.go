@@ -0,0 +1,97 @@
+package garden
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podCache watches the pods belonging to this worker, so the reads the atc
+// makes constantly don't each need a round trip to the api server
+type podCache struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   corelisters.PodLister
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newPodCache(cfg Config, client *kubernetes.Clientset) *podCache {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		0,
+		informers.WithNamespace(cfg.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = workerSelector(cfg).String()
+		}),
+	)
+
+	pods := factory.Core().V1().Pods()
+
+	return &podCache{
+		factory:  factory,
+		informer: pods.Informer(),
+		lister:   pods.Lister(),
+
+		stop: make(chan struct{}),
+	}
+}
+
+func (c *podCache) start() {
+	c.factory.Start(c.stop)
+}
+
+func (c *podCache) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// synced reports whether the cache has caught up with the api server. Until
+// it has, callers should fall back to reading from the api server directly.
+func (c *podCache) synced() bool {
+	return c.informer.HasSynced()
+}
+
+func (c *podCache) list(cfg Config) ([]corev1.Pod, error) {
+	cached, err := c.lister.Pods(cfg.Namespace).List(workerSelector(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	// the lister hands out the cache's own objects, which mustn't be modified
+	pods := make([]corev1.Pod, 0, len(cached))
+	for _, pod := range cached {
+		pods = append(pods, *pod.DeepCopy())
+	}
+
+	return pods, nil
+}
+
+// get looks up a pod in the cache, reporting whether it was found
+func (c *podCache) get(cfg Config, name string) (*corev1.Pod, bool, error) {
+	pod, err := c.lister.Pods(cfg.Namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return pod.DeepCopy(), true, nil
+}
+
+func workerSelector(cfg Config) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{
+		workerLabelKey: cfg.WorkerName,
+	})
+}
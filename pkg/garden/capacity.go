@@ -0,0 +1,156 @@
+package garden
+
+import (
+	"context"
+	"fmt"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CapacitySourceNode  = "node"
+	CapacitySourceQuota = "quota"
+)
+
+func (backend *GardenBackend) Capacity() (garden.Capacity, error) {
+	var available corev1.ResourceList
+	var err error
+
+	switch backend.config.CapacitySource {
+	case CapacitySourceQuota:
+		available, err = backend.quotaCapacity()
+	default:
+		available, err = backend.nodeCapacity()
+	}
+
+	if err != nil {
+		return garden.Capacity{}, err
+	}
+
+	maxContainers := quantityValue(available, corev1.ResourcePods)
+	if _, found := available[corev1.ResourcePods]; !found || maxContainers > backend.config.MaxContainers {
+		maxContainers = backend.config.MaxContainers
+	}
+
+	return garden.Capacity{
+		MemoryInBytes: quantityValue(available, corev1.ResourceMemory),
+		DiskInBytes:   quantityValue(available, corev1.ResourceEphemeralStorage),
+		MaxContainers: maxContainers,
+	}, nil
+}
+
+// nodeCapacity is whatever is left of the node's allocatable resources
+// once the pods already running on this worker have been accounted for
+func (backend *GardenBackend) nodeCapacity() (corev1.ResourceList, error) {
+	node, err := backend.client.CoreV1().
+		Nodes().
+		Get(context.Background(), backend.config.NodeName, metav1.GetOptions{})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node '%s': %w", backend.config.NodeName, err)
+	}
+
+	pods, err := backend.listPods()
+	if err != nil {
+		return nil, err
+	}
+
+	available := corev1.ResourceList{}
+	for _, name := range []corev1.ResourceName{corev1.ResourceMemory, corev1.ResourceEphemeralStorage, corev1.ResourcePods} {
+		if quantity, found := node.Status.Allocatable[name]; found {
+			available[name] = quantity.DeepCopy()
+		}
+	}
+
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		subtractQuantity(available, corev1.ResourcePods, *resource.NewQuantity(1, resource.DecimalSI))
+
+		for _, container := range pod.Spec.Containers {
+			for _, name := range []corev1.ResourceName{corev1.ResourceMemory, corev1.ResourceEphemeralStorage} {
+				if quantity, found := container.Resources.Requests[name]; found {
+					subtractQuantity(available, name, quantity)
+				} else if quantity, found := container.Resources.Limits[name]; found {
+					subtractQuantity(available, name, quantity)
+				}
+			}
+		}
+	}
+
+	return available, nil
+}
+
+// quotaCapacity is the tightest of the namespace's resource quotas, which
+// already account for the pods running in the namespace
+func (backend *GardenBackend) quotaCapacity() (corev1.ResourceList, error) {
+	quotas, err := backend.client.CoreV1().
+		ResourceQuotas(backend.config.Namespace).
+		List(context.Background(), metav1.ListOptions{})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list resource quotas: %w", err)
+	}
+
+	quotaResources := map[corev1.ResourceName][]corev1.ResourceName{
+		corev1.ResourceMemory: {
+			corev1.ResourceLimitsMemory,
+			corev1.ResourceRequestsMemory,
+			corev1.ResourceMemory,
+		},
+		corev1.ResourceEphemeralStorage: {
+			corev1.ResourceLimitsEphemeralStorage,
+			corev1.ResourceRequestsEphemeralStorage,
+			corev1.ResourceEphemeralStorage,
+		},
+		corev1.ResourcePods: {
+			corev1.ResourcePods,
+			"count/pods",
+		},
+	}
+
+	available := corev1.ResourceList{}
+	for _, quota := range quotas.Items {
+		for name, quotaNames := range quotaResources {
+			for _, quotaName := range quotaNames {
+				hard, found := quota.Status.Hard[quotaName]
+				if !found {
+					continue
+				}
+
+				remaining := hard.DeepCopy()
+				remaining.Sub(quota.Status.Used[quotaName])
+
+				if current, found := available[name]; !found || remaining.Cmp(current) < 0 {
+					available[name] = remaining
+				}
+			}
+		}
+	}
+
+	return available, nil
+}
+
+func subtractQuantity(resources corev1.ResourceList, name corev1.ResourceName, quantity resource.Quantity) {
+	current, found := resources[name]
+	if !found {
+		return
+	}
+
+	current.Sub(quantity)
+	resources[name] = current
+}
+
+func quantityValue(resources corev1.ResourceList, name corev1.ResourceName) uint64 {
+	quantity, found := resources[name]
+	if !found || quantity.Sign() <= 0 {
+		return 0
+	}
+
+	return uint64(quantity.Value())
+}
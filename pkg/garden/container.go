@@ -1,20 +1,39 @@
 package garden
 
 import (
-	"context"
+	"bytes"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/garden"
+	"github.com/concourse/concourse/worker/baggageclaim"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// each poll execs into the container, to ask init what's still running
+	stopPollInterval = 500 * time.Millisecond
 )
 
 type Container struct {
-	client *kubernetes.Clientset
-	pod    corev1.Pod
+	config Config
+
+	client       *kubernetes.Clientset
+	restConfig   *rest.Config
+	baggageclaim baggageclaim.Client
+
+	pod       corev1.Pod
+	metrics   metricsCollector
+	processes *processTracker
 }
 
 var _ garden.Container = &Container{}
@@ -23,86 +42,386 @@ func (c Container) Handle() string {
 	return c.pod.Name
 }
 
+// Stop terminates every process in the container, leaving the pod itself in
+// place until the container is destroyed. Any processes still running once
+// the stop timeout is up are killed, including any started by a previous
+// garden server.
 func (c Container) Stop(kill bool) error {
-	err := c.client.CoreV1().
-		Pods(c.pod.Namespace).
-		Delete(context.Background(), c.pod.Name, metav1.DeleteOptions{})
+	stopped := "true"
+	if err := c.patchAnnotations(map[string]*string{stoppedAnnotation: &stopped}); err != nil {
+		return err
+	}
+
+	if c.pod.Status.Phase != corev1.PodRunning {
+		return nil
+	}
+
+	if !kill {
+		if err := c.signalAll("TERM"); err != nil {
+			return err
+		}
+
+		err := wait.PollImmediate(stopPollInterval, c.config.StopTimeout, func() (bool, error) {
+			running, err := c.runningProcesses()
+			return running == 0, err
+		})
+		if err == nil {
+			return nil
+		}
+	}
+
+	return c.signalAll("KILL")
+}
 
-	if !apierrors.IsNotFound(err) {
+func (c Container) signalAll(signal string) error {
+	executor, err := c.executor([]string{initBinaryPath, "--signal-all", signal, "--processes-dir", processesPath}, false)
+	if err != nil {
 		return err
 	}
 
+	stderr := new(bytes.Buffer)
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdout: io.Discard,
+		Stderr: stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send %s to processes: %w (stderr: %q)", signal, err, stderr.String())
+	}
+
 	return nil
 }
 
-func (c Container) Info() (garden.ContainerInfo, error) {
-	return garden.ContainerInfo{}, ErrUnsupported
-}
+// runningProcesses asks init how many of the container's processes are still
+// running, including any started by a previous garden server, which the pod's
+// annotations may still claim are running long after they've gone
+func (c Container) runningProcesses() (int, error) {
+	if c.pod.Status.Phase != corev1.PodRunning {
+		return 0, nil
+	}
 
-func (c Container) StreamIn(spec garden.StreamInSpec) error {
-	return ErrUnsupported
-}
+	executor, err := c.executor([]string{initBinaryPath, "--list-running", "--processes-dir", processesPath}, false)
+	if err != nil {
+		return 0, err
+	}
 
-func (c Container) StreamOut(spec garden.StreamOutSpec) (io.ReadCloser, error) {
-	return nil, ErrUnsupported
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list running processes: %w (stderr: %q)", err, stderr.String())
+	}
+
+	return len(strings.Fields(stdout.String())), nil
 }
 
 func (c Container) CurrentBandwidthLimits() (garden.BandwidthLimits, error) {
 	return garden.BandwidthLimits{}, ErrUnsupported
 }
 
-func (c Container) CurrentCPULimits() (garden.CPULimits, error) {
-	return garden.CPULimits{}, ErrUnsupported
-}
+func (c Container) Run(spec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
+	id := spec.ID
+	if id == "" {
+		id = string(uuid.NewUUID())
+	}
 
-func (c Container) CurrentDiskLimits() (garden.DiskLimits, error) {
-	return garden.DiskLimits{}, ErrUnsupported
-}
+	// processes are detached from their exec session, so they keep running
+	// (and can be attached to again) if the garden server goes away. Any tty
+	// belongs to init rather than the exec session for the same reason.
+	command := []string{initBinaryPath, "--process-dir", processDir(id), "--detach"}
+	command = append(command, c.rootArgs()...)
+	if spec.TTY != nil {
+		command = append(command, "--tty")
 
-func (c Container) CurrentMemoryLimits() (garden.MemoryLimits, error) {
-	return garden.MemoryLimits{}, ErrUnsupported
-}
+		if size := spec.TTY.WindowSize; size != nil {
+			command = append(command, "--window-size", windowSize(size))
+		}
+	}
 
-func (c Container) NetIn(hostPort, containerPort uint32) (uint32, uint32, error) {
-	return 0, 0, ErrUnsupported
+	if spec.Dir != "" {
+		command = append(command, "--dir", spec.Dir)
+	}
+
+	if spec.User != "" {
+		command = append(command, "--user", spec.User)
+	}
+
+	command = append(command, rlimitArgs(spec.Limits)...)
+
+	for _, capability := range droppedCapabilities(c.pod) {
+		command = append(command, "--drop-capability", capability)
+	}
+
+	// an environment too big for the exec request's url is written to a
+	// file in the container instead
+	if envSize(spec.Env) > maxEnvArgsSize {
+		if err := c.writeEnvFile(id, spec.Env); err != nil {
+			return nil, err
+		}
+
+		command = append(command, "--env-file", processEnvFile(id))
+	} else {
+		for _, env := range spec.Env {
+			command = append(command, "--env", env)
+		}
+	}
+
+	command = append(command, "--", spec.Path)
+	command = append(command, spec.Args...)
+
+	if err := c.touch(); err != nil {
+		return nil, err
+	}
+
+	executor, err := c.executor(command, processIO.Stdin != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	process := newProcess(id, spec.TTY != nil, c.controlProcess(id))
+	if err := c.processes.track(c.Handle(), process); err != nil {
+		return nil, err
+	}
+
+	process.attach(processIO)
+
+	if err := c.recordProcessStatus(id, processRunningStatus); err != nil {
+		// the process was never started, and nothing can wait on it
+		c.processes.untrack(c.Handle(), process)
+		return nil, err
+	}
+
+	go c.streamProcess(process, executor, remotecommand.StreamOptions{
+		Stdin:  processIO.Stdin,
+		Stdout: process.stdout,
+		Stderr: process.stderr,
+	})
+
+	return process, nil
 }
 
-func (c Container) NetOut(netOutRule garden.NetOutRule) error {
-	return ErrUnsupported
+func (c Container) Attach(processID string, processIO garden.ProcessIO) (garden.Process, error) {
+	if err := c.touch(); err != nil {
+		return nil, err
+	}
+
+	if process, found := c.processes.lookup(c.Handle(), processID); found {
+		process.attach(processIO)
+		return process, nil
+	}
+
+	key, err := encodeAnnotationKey(processAnnotationPrefix, processID)
+	if err != nil {
+		return nil, err
+	}
+
+	status, found := c.pod.Annotations[key]
+	if !found {
+		return nil, garden.ProcessNotFoundError{ProcessID: processID}
+	}
+
+	if status == processRunningStatus {
+		return c.reattach(processID, processIO)
+	}
+
+	exitStatus, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, fmt.Errorf("malformed exit status for process '%s': %w", processID, err)
+	}
+
+	return newExitedProcess(processID, exitStatus), nil
 }
 
-func (c Container) BulkNetOut(netOutRules []garden.NetOutRule) error {
-	return ErrUnsupported
+// reattach picks up a process started by a previous garden server, from the
+// directory init keeps its output and exit status in. The process' stdin
+// went away with the previous server's exec session.
+func (c Container) reattach(processID string, processIO garden.ProcessIO) (garden.Process, error) {
+	// whether the process has a tty wasn't recorded, so assume it does; init
+	// ignores resizes for processes without one
+	process := newProcess(processID, true, c.controlProcess(processID))
+
+	executor, err := c.executor(attachCommand(process), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.processes.track(c.Handle(), process); err != nil {
+		// someone else may have just beaten us to it
+		existing, found := c.processes.lookup(c.Handle(), processID)
+		if !found {
+			return nil, err
+		}
+
+		existing.attach(processIO)
+		return existing, nil
+	}
+
+	process.attach(processIO)
+
+	go c.streamProcess(process, executor, remotecommand.StreamOptions{
+		Stdout: process.stdout,
+		Stderr: process.stderr,
+	})
+
+	return process, nil
 }
 
-func (c Container) Run(garden.ProcessSpec, garden.ProcessIO) (garden.Process, error) {
-	return nil, ErrUnsupported
+// controlProcess sends requests to the init keeping a detached process, for
+// the things an exec session can't carry
+func (c Container) controlProcess(processID string) func(args ...string) error {
+	return func(args ...string) error {
+		command := append([]string{initBinaryPath, "--process-dir", processDir(processID)}, args...)
+
+		executor, err := c.executor(command, false)
+		if err != nil {
+			return err
+		}
+
+		stderr := new(bytes.Buffer)
+		err = executor.Stream(remotecommand.StreamOptions{
+			Stdout: io.Discard,
+			Stderr: stderr,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to control process '%s': %w (stderr: %q)", processID, err, stderr.String())
+		}
+
+		return nil
+	}
 }
 
-func (c Container) Attach(processID string, io garden.ProcessIO) (garden.Process, error) {
-	return nil, ErrUnsupported
+// rootArgs has init run things inside the container's rootfs volume, if it
+// has one
+func (c Container) rootArgs() []string {
+	if root := podRoot(c.pod); root != "" {
+		return []string{"--root", root}
+	}
+
+	return nil
 }
 
-func (c Container) Metrics() (garden.Metrics, error) {
-	return garden.Metrics{}, ErrUnsupported
+// writeEnvFile writes a process' environment to the file init reads it from
+// with --env-file, as NUL separated entries. It's written by init, rather than
+// streamed in, so it stays outside of any rootfs volume along with the
+// process' keeper.
+func (c Container) writeEnvFile(processID string, env []string) error {
+	contents := []byte{}
+	for _, e := range env {
+		contents = append(contents, e...)
+		contents = append(contents, 0)
+	}
+
+	executor, err := c.executor([]string{initBinaryPath, "--write-env-file", processEnvFile(processID)}, true)
+	if err != nil {
+		return err
+	}
+
+	stderr := new(bytes.Buffer)
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdin:  bytes.NewReader(contents),
+		Stdout: io.Discard,
+		Stderr: stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write environment for process '%s': %w (stderr: %q)", processID, err, stderr.String())
+	}
+
+	return nil
 }
 
-func (c Container) SetGraceTime(graceTime time.Duration) error {
-	return ErrUnsupported
+// streamProcess follows a process' exec session until it ends, recording the
+// process' exit status on the pod. The process carries on regardless of the
+// session, so if it breaks, the process is attached to again, picking its
+// output up from where it left off.
+func (c Container) streamProcess(process *Process, executor remotecommand.Executor, options remotecommand.StreamOptions) {
+	err := executor.Stream(options)
+	for attempt := 0; streamBroken(err) && attempt < maxReattachAttempts; attempt++ {
+		time.Sleep(reattachInterval)
+		err = c.resumeProcess(process)
+	}
+
+	process.finish(err)
+
+	if process.err != nil {
+		// the process is most likely still running, and is left marked as
+		// such, so a later attach can try to pick it up again
+		c.processes.untrack(c.Handle(), process)
+		return
+	}
+
+	// nothing is waiting on this, and failing to record the status only
+	// matters if the garden server restarts before the atc attaches. Until
+	// it's recorded, init's copy of it is all there is.
+	err = c.recordProcessStatus(process.ID(), strconv.Itoa(process.exitStatus))
+	if err == nil {
+		// the process' output counts towards the pod's storage, and isn't
+		// needed anymore
+		_ = process.control("--remove")
+	}
+
+	time.AfterFunc(exitedProcessRetention, func() {
+		c.processes.untrack(c.Handle(), process)
+	})
 }
 
-func (c Container) Properties() (garden.Properties, error) {
-	return nil, ErrUnsupported
+// resumeProcess attaches to a process again after its exec session broke.
+// Its stdin went away with the session.
+func (c Container) resumeProcess(process *Process) error {
+	executor, err := c.executor(attachCommand(process), false)
+	if err != nil {
+		return err
+	}
+
+	return executor.Stream(remotecommand.StreamOptions{
+		Stdout: process.stdout,
+		Stderr: process.stderr,
+	})
 }
 
-func (c Container) Property(name string) (string, error) {
-	return "", ErrUnsupported
+// attachCommand has init copy a detached process' output, skipping anything
+// the process has already received
+func attachCommand(process *Process) []string {
+	return []string{
+		initBinaryPath, "--attach", processDir(process.ID()),
+		"--stdout-offset", strconv.FormatInt(process.stdout.size(), 10),
+		"--stderr-offset", strconv.FormatInt(process.stderr.size(), 10),
+	}
 }
 
-func (c Container) SetProperty(name string, value string) error {
-	return ErrUnsupported
+// recordProcessStatus persists a process' status on the pod, so it can be
+// recovered if the garden server restarts. An empty status removes it.
+func (c Container) recordProcessStatus(processID string, status string) error {
+	key, err := encodeAnnotationKey(processAnnotationPrefix, processID)
+	if err != nil {
+		return err
+	}
+
+	var value *string
+	if status != "" {
+		value = &status
+	}
+
+	return c.patchAnnotations(map[string]*string{key: value})
 }
 
-func (c Container) RemoveProperty(name string) error {
-	return ErrUnsupported
+func (c Container) executor(command []string, stdin bool) (remotecommand.Executor, error) {
+	execOptions := &corev1.PodExecOptions{
+		Container: stepContainerName,
+		Command:   command,
+
+		Stdin:  stdin,
+		Stdout: true,
+		Stderr: true,
+	}
+
+	request := c.client.CoreV1().RESTClient().
+		Post().
+		Namespace(c.pod.Namespace).
+		Resource("pods").
+		Name(c.pod.Name).
+		SubResource("exec").
+		VersionedParams(execOptions, scheme.ParameterCodec)
+
+	return remotecommand.NewSPDYExecutor(c.restConfig, "POST", request.URL())
 }
@@ -0,0 +1,132 @@
+package garden
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	graceTimeAnnotation    = "garden.k8s.concourse-ci.org/grace-time"
+	lastActivityAnnotation = "garden.k8s.concourse-ci.org/last-activity"
+
+	neverExpires = time.Duration(math.MaxInt64)
+)
+
+// GraceTime is only used by the garden server's bomberman, which keeps its
+// timers in memory, and so can't account for activity from before the server
+// started, or for processes which carry on without a client attached.
+// Containers are instead reaped by the GardenServer from their annotations,
+// and the bomberman is given a grace time which never runs out. A zero grace
+// time would have it destroy a container as soon as its grace time is set.
+func (backend *GardenBackend) GraceTime(container garden.Container) time.Duration {
+	return neverExpires
+}
+
+func (c Container) SetGraceTime(graceTime time.Duration) error {
+	value := graceTime.String()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	return c.patchAnnotations(map[string]*string{
+		graceTimeAnnotation:    &value,
+		lastActivityAnnotation: &now,
+	})
+}
+
+// touch records that the container is still in use, pushing back the point
+// at which it expires
+func (c Container) touch() error {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	return c.patchAnnotations(map[string]*string{
+		lastActivityAnnotation: &now,
+	})
+}
+
+func graceTimeAnnotations(graceTime time.Duration, now time.Time) map[string]string {
+	return map[string]string{
+		graceTimeAnnotation:    graceTime.String(),
+		lastActivityAnnotation: now.UTC().Format(time.RFC3339),
+	}
+}
+
+func podGraceTime(pod corev1.Pod) time.Duration {
+	graceTime, err := time.ParseDuration(pod.Annotations[graceTimeAnnotation])
+	if err != nil {
+		return 0
+	}
+
+	return graceTime
+}
+
+// podExpired reports whether a pod has gone unused for longer than its grace
+// time. Pods without a grace time never expire.
+func podExpired(pod corev1.Pod, now time.Time) bool {
+	graceTime := podGraceTime(pod)
+	if graceTime <= 0 {
+		return false
+	}
+
+	lastActivity, err := time.Parse(time.RFC3339, pod.Annotations[lastActivityAnnotation])
+	if err != nil {
+		lastActivity = pod.CreationTimestamp.Time
+	}
+
+	return now.Sub(lastActivity) > graceTime
+}
+
+// expiredContainers finds the handles of containers which have outlived their
+// grace time, ignoring any with processes still running. Processes started by
+// a previous garden server are only known about from the pod's annotations,
+// which stay marked as running if nobody was around to see them exit, so init
+// is asked whether they really are. Containers init couldn't be asked about
+// are left alone, with the first failure reported alongside any which have
+// expired.
+func (backend *GardenBackend) expiredContainers(now time.Time) ([]string, error) {
+	pods, err := backend.listPods()
+	if err != nil {
+		return nil, err
+	}
+
+	handles := []string{}
+	var firstErr error
+
+	for _, pod := range pods {
+		if !podExpired(pod, now) || backend.processes.hasRunning(pod.Name) {
+			continue
+		}
+
+		if podHasRunningProcesses(pod) {
+			running, err := backend.newContainer(pod).runningProcesses()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to check processes in container '%s': %w", pod.Name, err)
+				}
+
+				continue
+			}
+
+			if running > 0 {
+				continue
+			}
+		}
+
+		handles = append(handles, pod.Name)
+	}
+
+	return handles, firstErr
+}
+
+func podHasRunningProcesses(pod corev1.Pod) bool {
+	for key, value := range pod.Annotations {
+		if strings.HasPrefix(key, processAnnotationPrefix) && value == processRunningStatus {
+			return true
+		}
+	}
+
+	return false
+}
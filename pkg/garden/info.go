@@ -0,0 +1,101 @@
+package garden
+
+import (
+	"sort"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	containerStateActive  = "active"
+	containerStateStopped = "stopped"
+
+	stoppedAnnotation = "garden.k8s.concourse-ci.org/stopped"
+)
+
+func (c Container) Info() (garden.ContainerInfo, error) {
+	return infoForPod(c.pod), nil
+}
+
+func infoForPod(pod corev1.Pod) garden.ContainerInfo {
+	return garden.ContainerInfo{
+		State:  containerState(pod),
+		Events: containerEvents(pod),
+
+		HostIP:      pod.Status.HostIP,
+		ContainerIP: pod.Status.PodIP,
+		ExternalIP:  pod.Status.HostIP,
+
+		ProcessIDs: runningProcessIDs(pod),
+		Properties: propertiesFromAnnotations(pod.Annotations),
+
+		MappedPorts: mappedPorts(pod),
+	}
+}
+
+func containerState(pod corev1.Pod) string {
+	if _, stopped := pod.Annotations[stoppedAnnotation]; stopped {
+		return containerStateStopped
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodPending:
+		return containerStateActive
+
+	case corev1.PodRunning:
+		status, found := stepContainerStatus(pod)
+		if found && status.State.Terminated != nil {
+			return containerStateStopped
+		}
+
+		return containerStateActive
+
+	default:
+		return containerStateStopped
+	}
+}
+
+func containerEvents(pod corev1.Pod) []string {
+	events := []string{}
+
+	status, found := stepContainerStatus(pod)
+	if !found {
+		return events
+	}
+
+	for _, state := range []corev1.ContainerState{status.State, status.LastTerminationState} {
+		if state.Terminated != nil && state.Terminated.Reason == "OOMKilled" {
+			events = append(events, "oom")
+			break
+		}
+	}
+
+	return events
+}
+
+func stepContainerStatus(pod corev1.Pod) (corev1.ContainerStatus, bool) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == stepContainerName {
+			return status, true
+		}
+	}
+
+	return corev1.ContainerStatus{}, false
+}
+
+func runningProcessIDs(pod corev1.Pod) []string {
+	ids := []string{}
+	for key, status := range pod.Annotations {
+		if status != processRunningStatus {
+			continue
+		}
+
+		if id, found := decodeAnnotationKey(processAnnotationPrefix, key); found {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,186 @@
+package garden
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// effectiveLimits fills in any limits a container didn't ask for with the
+// configured defaults, and caps them at the configured maximums. Pid limits
+// aren't included, as kubernetes only supports setting them for a whole node.
+func (backend *GardenBackend) effectiveLimits(limits garden.Limits) garden.Limits {
+	defaults := backend.config.DefaultLimits
+	maximums := backend.config.MaxLimits
+
+	// kubernetes rejects requests which are higher than their limit
+	diskHard := hardLimit(limits.Disk.ByteHard, defaults.Disk.ByteHard, maximums.Disk.ByteHard)
+
+	return garden.Limits{
+		CPU: garden.CPULimits{
+			Weight: softLimit(cpuShares(limits.CPU), cpuShares(defaults.CPU), cpuShares(maximums.CPU)),
+		},
+		Memory: garden.MemoryLimits{
+			LimitInBytes: hardLimit(limits.Memory.LimitInBytes, defaults.Memory.LimitInBytes, maximums.Memory.LimitInBytes),
+		},
+		Disk: garden.DiskLimits{
+			ByteSoft: softLimit(limits.Disk.ByteSoft, defaults.Disk.ByteSoft, diskHard),
+			ByteHard: diskHard,
+		},
+	}
+}
+
+// hardLimit picks the default when no limit was given, and caps the result
+// at the maximum if there is one. A zero limit means the container is
+// unlimited, so is capped too.
+func hardLimit(limit, def, maximum uint64) uint64 {
+	if limit == 0 {
+		limit = def
+	}
+
+	if maximum > 0 && (limit == 0 || limit > maximum) {
+		limit = maximum
+	}
+
+	return limit
+}
+
+// softLimit picks the default when no limit was given, and caps the result
+// at the maximum if there is one. A zero limit leaves it up to kubernetes.
+func softLimit(limit, def, maximum uint64) uint64 {
+	if limit == 0 {
+		limit = def
+	}
+
+	if maximum > 0 && limit > maximum {
+		limit = maximum
+	}
+
+	return limit
+}
+
+func cpuShares(limits garden.CPULimits) uint64 {
+	if limits.Weight != 0 {
+		return limits.Weight
+	}
+
+	return limits.LimitInShares
+}
+
+func resourcesForLimits(limits garden.Limits) corev1.ResourceRequirements {
+	requirements := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{},
+		Limits:   corev1.ResourceList{},
+	}
+
+	if limits.Memory.LimitInBytes > 0 {
+		requirements.Limits[corev1.ResourceMemory] = *resource.NewQuantity(
+			int64(limits.Memory.LimitInBytes),
+			resource.BinarySI,
+		)
+	}
+
+	// garden cpu weights map onto cgroup cpu shares, where 1024 shares
+	// corresponds to a single cpu
+	if shares := cpuShares(limits.CPU); shares > 0 {
+		requirements.Requests[corev1.ResourceCPU] = *resource.NewMilliQuantity(
+			int64(shares*1000/1024),
+			resource.DecimalSI,
+		)
+	}
+
+	if limits.Disk.ByteSoft > 0 {
+		requirements.Requests[corev1.ResourceEphemeralStorage] = *resource.NewQuantity(
+			int64(limits.Disk.ByteSoft),
+			resource.BinarySI,
+		)
+	}
+
+	if limits.Disk.ByteHard > 0 {
+		requirements.Limits[corev1.ResourceEphemeralStorage] = *resource.NewQuantity(
+			int64(limits.Disk.ByteHard),
+			resource.BinarySI,
+		)
+	}
+
+	return requirements
+}
+
+// rlimitArgs passes a process' rlimits on to init, which sets them before
+// running the process
+func rlimitArgs(limits garden.ResourceLimits) []string {
+	rlimits := []struct {
+		name  string
+		value *uint64
+	}{
+		{"as", limits.As},
+		{"core", limits.Core},
+		{"cpu", limits.Cpu},
+		{"data", limits.Data},
+		{"fsize", limits.Fsize},
+		{"locks", limits.Locks},
+		{"memlock", limits.Memlock},
+		{"msgqueue", limits.Msgqueue},
+		{"nice", limits.Nice},
+		{"nofile", limits.Nofile},
+		{"nproc", limits.Nproc},
+		{"rss", limits.Rss},
+		{"rtprio", limits.Rtprio},
+		{"sigpending", limits.Sigpending},
+		{"stack", limits.Stack},
+	}
+
+	args := []string{}
+	for _, rlimit := range rlimits {
+		if rlimit.value != nil {
+			args = append(args, "--rlimit", fmt.Sprintf("%s=%d", rlimit.name, *rlimit.value))
+		}
+	}
+
+	return args
+}
+
+func (c Container) CurrentCPULimits() (garden.CPULimits, error) {
+	container, found := stepContainer(c.pod)
+	if !found {
+		return garden.CPULimits{}, nil
+	}
+
+	cpu := container.Resources.Requests[corev1.ResourceCPU]
+	shares := uint64(cpu.MilliValue() * 1024 / 1000)
+
+	return garden.CPULimits{
+		Weight:        shares,
+		LimitInShares: shares,
+	}, nil
+}
+
+func (c Container) CurrentDiskLimits() (garden.DiskLimits, error) {
+	container, found := stepContainer(c.pod)
+	if !found {
+		return garden.DiskLimits{}, nil
+	}
+
+	soft := container.Resources.Requests[corev1.ResourceEphemeralStorage]
+	hard := container.Resources.Limits[corev1.ResourceEphemeralStorage]
+
+	return garden.DiskLimits{
+		ByteSoft: uint64(soft.Value()),
+		ByteHard: uint64(hard.Value()),
+	}, nil
+}
+
+func (c Container) CurrentMemoryLimits() (garden.MemoryLimits, error) {
+	container, found := stepContainer(c.pod)
+	if !found {
+		return garden.MemoryLimits{}, nil
+	}
+
+	memory := container.Resources.Limits[corev1.ResourceMemory]
+
+	return garden.MemoryLimits{
+		LimitInBytes: uint64(memory.Value()),
+	}, nil
+}
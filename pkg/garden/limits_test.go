@@ -0,0 +1,126 @@
+package garden
+
+import (
+	"testing"
+
+	"code.cloudfoundry.org/garden"
+)
+
+func TestEffectiveLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults garden.Limits
+		maximums garden.Limits
+		limits   garden.Limits
+		expected garden.Limits
+	}{
+		{
+			name:     "no limits",
+			expected: garden.Limits{},
+		},
+		{
+			name: "defaults fill in missing limits",
+			defaults: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 512},
+				Memory: garden.MemoryLimits{LimitInBytes: 1024},
+				Disk:   garden.DiskLimits{ByteSoft: 100, ByteHard: 200},
+			},
+			expected: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 512},
+				Memory: garden.MemoryLimits{LimitInBytes: 1024},
+				Disk:   garden.DiskLimits{ByteSoft: 100, ByteHard: 200},
+			},
+		},
+		{
+			name: "requested limits take precedence over defaults",
+			defaults: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 512},
+				Memory: garden.MemoryLimits{LimitInBytes: 1024},
+			},
+			limits: garden.Limits{
+				CPU:    garden.CPULimits{LimitInShares: 256},
+				Memory: garden.MemoryLimits{LimitInBytes: 2048},
+			},
+			expected: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 256},
+				Memory: garden.MemoryLimits{LimitInBytes: 2048},
+			},
+		},
+		{
+			name: "limits are capped at the maximums",
+			maximums: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 1024},
+				Memory: garden.MemoryLimits{LimitInBytes: 4096},
+				Disk:   garden.DiskLimits{ByteHard: 300},
+			},
+			limits: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 2048},
+				Memory: garden.MemoryLimits{LimitInBytes: 8192},
+				Disk:   garden.DiskLimits{ByteHard: 600},
+			},
+			expected: garden.Limits{
+				CPU:    garden.CPULimits{Weight: 1024},
+				Memory: garden.MemoryLimits{LimitInBytes: 4096},
+				Disk:   garden.DiskLimits{ByteHard: 300},
+			},
+		},
+		{
+			name: "unlimited hard limits are capped at the maximums",
+			maximums: garden.Limits{
+				Memory: garden.MemoryLimits{LimitInBytes: 4096},
+				Disk:   garden.DiskLimits{ByteHard: 300},
+			},
+			expected: garden.Limits{
+				Memory: garden.MemoryLimits{LimitInBytes: 4096},
+				Disk:   garden.DiskLimits{ByteHard: 300},
+			},
+		},
+		{
+			name: "unset soft limits are left unset",
+			maximums: garden.Limits{
+				CPU: garden.CPULimits{Weight: 1024},
+			},
+			expected: garden.Limits{},
+		},
+		{
+			name: "soft disk limit is capped at the requested hard limit",
+			limits: garden.Limits{
+				Disk: garden.DiskLimits{ByteSoft: 500, ByteHard: 200},
+			},
+			expected: garden.Limits{
+				Disk: garden.DiskLimits{ByteSoft: 200, ByteHard: 200},
+			},
+		},
+		{
+			name: "soft disk limit is capped at the default hard limit",
+			defaults: garden.Limits{
+				Disk: garden.DiskLimits{ByteHard: 200},
+			},
+			maximums: garden.Limits{
+				Disk: garden.DiskLimits{ByteHard: 1000},
+			},
+			limits: garden.Limits{
+				Disk: garden.DiskLimits{ByteSoft: 500},
+			},
+			expected: garden.Limits{
+				Disk: garden.DiskLimits{ByteSoft: 200, ByteHard: 200},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &GardenBackend{
+				config: Config{
+					DefaultLimits: test.defaults,
+					MaxLimits:     test.maximums,
+				},
+			}
+
+			actual := backend.effectiveLimits(test.limits)
+			if actual != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, actual)
+			}
+		})
+	}
+}
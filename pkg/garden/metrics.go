@@ -0,0 +1,250 @@
+package garden
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+// metricsCollector gathers container metrics from the summary api of the
+// kubelet running the worker's pods, falling back to the metrics api
+type metricsCollector struct {
+	config Config
+
+	client  *kubernetes.Clientset
+	metrics metricsclient.Interface
+}
+
+func (c Container) Metrics() (garden.Metrics, error) {
+	metrics, err := c.metrics.collect([]corev1.Pod{c.pod})
+	if err != nil {
+		return garden.Metrics{}, err
+	}
+
+	return metrics[c.Handle()], nil
+}
+
+func (collector metricsCollector) collect(pods []corev1.Pod) (map[string]garden.Metrics, error) {
+	summary, summaryErr := collector.nodeSummary()
+
+	podStats := map[string]statsv1alpha1.PodStats{}
+	if summary != nil {
+		for _, stats := range summary.Pods {
+			if stats.PodRef.Namespace == collector.config.Namespace {
+				podStats[stats.PodRef.Name] = stats
+			}
+		}
+	}
+
+	// the metrics api is optional, and is only needed for pods the summary
+	// has nothing on, such as those which have only just started
+	var podMetrics map[string]metricsv1beta1.PodMetrics
+	for _, pod := range pods {
+		if _, found := podStats[pod.Name]; !found {
+			podMetrics, _ = collector.podMetrics(pods)
+			break
+		}
+	}
+
+	if summaryErr != nil && podMetrics == nil {
+		return nil, fmt.Errorf("failed to fetch node stats summary: %w", summaryErr)
+	}
+
+	metrics := make(map[string]garden.Metrics, len(pods))
+	for _, pod := range pods {
+		stats, hasStats := podStats[pod.Name]
+		usage, hasUsage := podMetrics[pod.Name]
+
+		containerMetrics := garden.Metrics{
+			Age: podAge(pod),
+		}
+
+		if hasStats {
+			containerMetrics.MemoryStat, containerMetrics.CPUStat = summaryUsageMetrics(stats)
+			containerMetrics.DiskStat = diskMetrics(pod, stats)
+			containerMetrics.NetworkStat = networkMetrics(stats)
+			containerMetrics.PidStat = pidMetrics(stats)
+		} else if hasUsage {
+			containerMetrics.MemoryStat = usageMetrics(usage)
+		}
+
+		metrics[pod.Name] = containerMetrics
+	}
+
+	return metrics, nil
+}
+
+func (collector metricsCollector) podMetrics(pods []corev1.Pod) (map[string]metricsv1beta1.PodMetrics, error) {
+	podMetricsClient := collector.metrics.MetricsV1beta1().PodMetricses(collector.config.Namespace)
+
+	var items []metricsv1beta1.PodMetrics
+	if len(pods) == 1 {
+		podMetrics, err := podMetricsClient.Get(context.Background(), pods[0].Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		items = []metricsv1beta1.PodMetrics{*podMetrics}
+	} else {
+		selector := fmt.Sprintf("%s=%s", workerLabelKey, collector.config.WorkerName)
+		list, err := podMetricsClient.List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+
+		items = list.Items
+	}
+
+	podMetrics := make(map[string]metricsv1beta1.PodMetrics, len(items))
+	for _, item := range items {
+		podMetrics[item.Name] = item
+	}
+
+	return podMetrics, nil
+}
+
+func (collector metricsCollector) nodeSummary() (*statsv1alpha1.Summary, error) {
+	data, err := collector.client.CoreV1().RESTClient().
+		Get().
+		Resource("nodes").
+		Name(collector.config.NodeName).
+		SubResource("proxy").
+		Suffix("stats", "summary").
+		DoRaw(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &statsv1alpha1.Summary{}
+	if err := json.Unmarshal(data, summary); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+func podAge(pod corev1.Pod) time.Duration {
+	if pod.Status.StartTime != nil {
+		return time.Since(pod.Status.StartTime.Time)
+	}
+
+	return time.Since(pod.CreationTimestamp.Time)
+}
+
+// usageMetrics only reports memory usage, as the metrics api reports cpu
+// usage as a rate over its window, where garden reports the total cpu time
+// used, and the atc works out rates from that itself
+func usageMetrics(podMetrics metricsv1beta1.PodMetrics) garden.ContainerMemoryStat {
+	for _, container := range podMetrics.Containers {
+		if container.Name != stepContainerName {
+			continue
+		}
+
+		memory := container.Usage.Memory().Value()
+
+		return garden.ContainerMemoryStat{TotalUsageTowardLimit: uint64(memory)}
+	}
+
+	return garden.ContainerMemoryStat{}
+}
+
+func summaryUsageMetrics(stats statsv1alpha1.PodStats) (garden.ContainerMemoryStat, garden.ContainerCPUStat) {
+	memoryStat := garden.ContainerMemoryStat{}
+	cpuStat := garden.ContainerCPUStat{}
+
+	for _, container := range stats.Containers {
+		if container.Name != stepContainerName {
+			continue
+		}
+
+		if memory := container.Memory; memory != nil {
+			memoryStat.TotalUsageTowardLimit = valueOrZero(memory.WorkingSetBytes)
+			memoryStat.Rss = valueOrZero(memory.RSSBytes)
+			memoryStat.TotalRss = valueOrZero(memory.RSSBytes)
+			memoryStat.Pgfault = valueOrZero(memory.PageFaults)
+			memoryStat.TotalPgfault = valueOrZero(memory.PageFaults)
+			memoryStat.Pgmajfault = valueOrZero(memory.MajorPageFaults)
+			memoryStat.TotalPgmajfault = valueOrZero(memory.MajorPageFaults)
+		}
+
+		if cpu := container.CPU; cpu != nil {
+			cpuStat.Usage = valueOrZero(cpu.UsageCoreNanoSeconds)
+		}
+	}
+
+	return memoryStat, cpuStat
+}
+
+func diskMetrics(pod corev1.Pod, stats statsv1alpha1.PodStats) garden.ContainerDiskStat {
+	volumes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.CSI == nil {
+			continue
+		}
+
+		if _, found := volume.CSI.VolumeAttributes[volumeHandleAttribute]; found {
+			volumes[volume.Name] = true
+		}
+	}
+
+	diskStat := garden.ContainerDiskStat{}
+	for _, volumeStats := range stats.VolumeStats {
+		if volumes[volumeStats.Name] {
+			diskStat.TotalBytesUsed += valueOrZero(volumeStats.UsedBytes)
+			diskStat.TotalInodesUsed += valueOrZero(volumeStats.InodesUsed)
+		}
+	}
+
+	// only the container's writable layer is guaranteed not to be shared with
+	// anything else, as baggageclaim volumes are often copy-on-write
+	for _, container := range stats.Containers {
+		if container.Name == stepContainerName && container.Rootfs != nil {
+			diskStat.ExclusiveBytesUsed = valueOrZero(container.Rootfs.UsedBytes)
+			diskStat.ExclusiveInodesUsed = valueOrZero(container.Rootfs.InodesUsed)
+		}
+	}
+
+	diskStat.TotalBytesUsed += diskStat.ExclusiveBytesUsed
+	diskStat.TotalInodesUsed += diskStat.ExclusiveInodesUsed
+
+	return diskStat
+}
+
+func networkMetrics(stats statsv1alpha1.PodStats) garden.ContainerNetworkStat {
+	if stats.Network == nil {
+		return garden.ContainerNetworkStat{}
+	}
+
+	return garden.ContainerNetworkStat{
+		RxBytes: valueOrZero(stats.Network.RxBytes),
+		TxBytes: valueOrZero(stats.Network.TxBytes),
+	}
+}
+
+func pidMetrics(stats statsv1alpha1.PodStats) garden.ContainerPidStat {
+	if stats.ProcessStats == nil {
+		return garden.ContainerPidStat{}
+	}
+
+	return garden.ContainerPidStat{
+		Current: valueOrZero(stats.ProcessStats.ProcessCount),
+	}
+}
+
+func valueOrZero(value *uint64) uint64 {
+	if value == nil {
+		return 0
+	}
+
+	return *value
+}
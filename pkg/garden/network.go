@@ -0,0 +1,375 @@
+package garden
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// containerLabelKey identifies a single step pod, so network policies and
+	// services can select it even when its name was generated by the api server
+	containerLabelKey = "garden.k8s.concourse-ci.org/container"
+
+	mappedPortsAnnotation = "garden.k8s.concourse-ci.org/mapped-ports"
+)
+
+// NetIn exposes a port of the container on its node through a NodePort
+// service. The host port has to be in the cluster's node port range, and is
+// picked by kubernetes when zero.
+func (c Container) NetIn(hostPort, containerPort uint32) (uint32, uint32, error) {
+	if containerPort == 0 {
+		containerPort = hostPort
+	}
+
+	if containerPort == 0 {
+		return 0, 0, errors.New("a host or container port must be specified")
+	}
+
+	if _, found := c.pod.Labels[containerLabelKey]; !found {
+		return 0, 0, fmt.Errorf("container '%s' has no '%s' label to select it by", c.Handle(), containerLabelKey)
+	}
+
+	port := corev1.ServicePort{
+		Name:       fmt.Sprintf("port-%d", containerPort),
+		Protocol:   corev1.ProtocolTCP,
+		Port:       int32(containerPort),
+		TargetPort: intstr.FromInt(int(containerPort)),
+		NodePort:   int32(hostPort),
+	}
+
+	services := c.client.CoreV1().Services(c.pod.Namespace)
+
+	var service *corev1.Service
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := services.Get(context.Background(), c.pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			service, err = services.Create(context.Background(), serviceForPod(c.pod, port), metav1.CreateOptions{})
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		replaced := false
+		for i, existingPort := range existing.Spec.Ports {
+			if existingPort.Name != port.Name {
+				continue
+			}
+
+			// mapping the same container port again hands back the existing
+			// mapping, unless it's wanted on a different host port
+			if hostPort == 0 || existingPort.NodePort == port.NodePort {
+				service = existing
+				return nil
+			}
+
+			existing.Spec.Ports[i] = port
+			replaced = true
+		}
+
+		if !replaced {
+			existing.Spec.Ports = append(existing.Spec.Ports, port)
+		}
+
+		service, err = services.Update(context.Background(), existing, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to expose port %d: %w", containerPort, err)
+	}
+
+	// the service has every port mapped so far, so record all of them rather
+	// than relying on the annotations of a pod we may have fetched a while ago
+	mappings := make([]garden.PortMapping, 0, len(service.Spec.Ports))
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Name == port.Name {
+			hostPort = uint32(servicePort.NodePort)
+		}
+
+		mappings = append(mappings, garden.PortMapping{
+			HostPort:      uint32(servicePort.NodePort),
+			ContainerPort: uint32(servicePort.TargetPort.IntValue()),
+		})
+	}
+
+	value, err := json.Marshal(mappings)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mappingsValue := string(value)
+	err = c.patchAnnotations(map[string]*string{
+		mappedPortsAnnotation: &mappingsValue,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return hostPort, containerPort, nil
+}
+
+// serviceForPod builds the service exposing a step pod's ports, which is
+// cleaned up alongside the pod
+func serviceForPod(pod corev1.Pod, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				workerLabelKey: pod.Labels[workerLabelKey],
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(&pod, corev1.SchemeGroupVersion.WithKind("Pod")),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeNodePort,
+			Selector: map[string]string{
+				containerLabelKey: pod.Labels[containerLabelKey],
+			},
+			Ports: ports,
+		},
+	}
+}
+
+func mappedPorts(pod corev1.Pod) []garden.PortMapping {
+	mappings := []garden.PortMapping{}
+
+	value, found := pod.Annotations[mappedPortsAnnotation]
+	if !found {
+		return mappings
+	}
+
+	if err := json.Unmarshal([]byte(value), &mappings); err != nil {
+		return []garden.PortMapping{}
+	}
+
+	return mappings
+}
+
+func (c Container) NetOut(netOutRule garden.NetOutRule) error {
+	return c.BulkNetOut([]garden.NetOutRule{netOutRule})
+}
+
+// BulkNetOut allows egress matching the given rules, on top of whatever's
+// already allowed. Egress is only restricted when configured to deny it by
+// default; otherwise all egress is already allowed, and there's nothing to do.
+func (c Container) BulkNetOut(netOutRules []garden.NetOutRule) error {
+	rules := make([]networkingv1.NetworkPolicyEgressRule, 0, len(netOutRules))
+	for _, netOutRule := range netOutRules {
+		rule, err := egressRule(netOutRule)
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	// a policy with only these rules would deny everything else, taking
+	// egress away rather than allowing more of it
+	if !c.config.DenyNetworkEgress {
+		return nil
+	}
+
+	if _, found := c.pod.Labels[containerLabelKey]; !found {
+		return fmt.Errorf("container '%s' has no '%s' label to select it by", c.Handle(), containerLabelKey)
+	}
+
+	policies := c.client.NetworkingV1().NetworkPolicies(c.pod.Namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		policy, err := policies.Get(context.Background(), c.pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return createNetworkPolicy(c.client, c.pod, rules)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		policy.Spec.Egress = append(policy.Spec.Egress, rules...)
+
+		_, err = policies.Update(context.Background(), policy, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// createNetworkPolicy creates the policy controlling a step pod's egress,
+// which is cleaned up alongside the pod
+func createNetworkPolicy(client kubernetes.Interface, pod corev1.Pod, rules []networkingv1.NetworkPolicyEgressRule) error {
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				workerLabelKey: pod.Labels[workerLabelKey],
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(&pod, corev1.SchemeGroupVersion.WithKind("Pod")),
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					containerLabelKey: pod.Labels[containerLabelKey],
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      rules,
+		},
+	}
+
+	_, err := client.NetworkingV1().
+		NetworkPolicies(pod.Namespace).
+		Create(context.Background(), policy, metav1.CreateOptions{})
+
+	return err
+}
+
+func egressRule(netOutRule garden.NetOutRule) (networkingv1.NetworkPolicyEgressRule, error) {
+	rule := networkingv1.NetworkPolicyEgressRule{}
+
+	for _, network := range netOutRule.Networks {
+		cidrs, err := cidrsForRange(network)
+		if err != nil {
+			return rule, err
+		}
+
+		for _, cidr := range cidrs {
+			rule.To = append(rule.To, networkingv1.NetworkPolicyPeer{
+				IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+			})
+		}
+	}
+
+	var protocols []corev1.Protocol
+	switch netOutRule.Protocol {
+	case garden.ProtocolAll:
+		// leaving out ports entirely allows every protocol, but a port range
+		// needs a protocol to go with it
+		if len(netOutRule.Ports) == 0 {
+			return rule, nil
+		}
+
+		protocols = []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}
+
+	case garden.ProtocolTCP:
+		protocols = []corev1.Protocol{corev1.ProtocolTCP}
+
+	case garden.ProtocolUDP:
+		protocols = []corev1.Protocol{corev1.ProtocolUDP}
+
+	case garden.ProtocolICMP:
+		return rule, errors.New("network policies cannot match icmp traffic")
+
+	default:
+		return rule, fmt.Errorf("unknown protocol %d", netOutRule.Protocol)
+	}
+
+	for _, protocol := range protocols {
+		protocol := protocol
+
+		if len(netOutRule.Ports) == 0 {
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{
+				Protocol: &protocol,
+			})
+
+			continue
+		}
+
+		for _, portRange := range netOutRule.Ports {
+			port := intstr.FromInt(int(portRange.Start))
+			policyPort := networkingv1.NetworkPolicyPort{
+				Protocol: &protocol,
+				Port:     &port,
+			}
+
+			if portRange.End > portRange.Start {
+				endPort := int32(portRange.End)
+				policyPort.EndPort = &endPort
+			}
+
+			rule.Ports = append(rule.Ports, policyPort)
+		}
+	}
+
+	return rule, nil
+}
+
+// cidrsForRange finds the smallest set of cidr blocks which exactly cover an
+// inclusive range of ip addresses
+func cidrsForRange(ipRange garden.IPRange) ([]string, error) {
+	start, end := ipRange.Start, ipRange.End
+	if end == nil {
+		end = start
+	}
+
+	size := net.IPv6len
+	if start.To4() != nil && end.To4() != nil {
+		size = net.IPv4len
+	}
+
+	startBytes, endBytes := ipBytes(start, size), ipBytes(end, size)
+	if startBytes == nil || endBytes == nil {
+		return nil, fmt.Errorf("invalid ip range %s-%s", start, end)
+	}
+
+	bits := uint(size * 8)
+	next := new(big.Int).SetBytes(startBytes)
+	last := new(big.Int).SetBytes(endBytes)
+
+	if next.Cmp(last) > 0 {
+		return nil, fmt.Errorf("invalid ip range %s-%s", start, end)
+	}
+
+	one := big.NewInt(1)
+
+	var cidrs []string
+	for next.Cmp(last) <= 0 {
+		// start with the largest block aligned to the next address, and
+		// shrink it until it doesn't run past the end of the range
+		hostBits := bits
+		if next.Sign() != 0 && next.TrailingZeroBits() < bits {
+			hostBits = next.TrailingZeroBits()
+		}
+
+		for hostBits > 0 {
+			blockEnd := new(big.Int).Lsh(one, hostBits)
+			blockEnd.Add(blockEnd, next).Sub(blockEnd, one)
+			if blockEnd.Cmp(last) <= 0 {
+				break
+			}
+
+			hostBits--
+		}
+
+		ip := net.IP(next.FillBytes(make([]byte, size)))
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", ip, bits-hostBits))
+
+		next.Add(next, new(big.Int).Lsh(one, hostBits))
+	}
+
+	return cidrs, nil
+}
+
+func ipBytes(ip net.IP, size int) []byte {
+	if size == net.IPv4len {
+		return ip.To4()
+	}
+
+	return ip.To16()
+}
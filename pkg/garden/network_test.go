@@ -0,0 +1,251 @@
+package garden
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestCidrsForRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "single address",
+			start:    "10.0.0.1",
+			expected: []string{"10.0.0.1/32"},
+		},
+		{
+			name:     "range of one address",
+			start:    "10.0.0.1",
+			end:      "10.0.0.1",
+			expected: []string{"10.0.0.1/32"},
+		},
+		{
+			name:     "aligned block",
+			start:    "10.0.0.0",
+			end:      "10.0.0.255",
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			name:     "aligned block spanning octets",
+			start:    "10.0.0.0",
+			end:      "10.0.1.255",
+			expected: []string{"10.0.0.0/23"},
+		},
+		{
+			name:     "unaligned start and end",
+			start:    "10.0.0.1",
+			end:      "10.0.0.6",
+			expected: []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"},
+		},
+		{
+			name:     "block one short of aligned",
+			start:    "10.0.0.0",
+			end:      "10.0.0.254",
+			expected: []string{"10.0.0.0/25", "10.0.0.128/26", "10.0.0.192/27", "10.0.0.224/28", "10.0.0.240/29", "10.0.0.248/30", "10.0.0.252/31", "10.0.0.254/32"},
+		},
+		{
+			name:     "crossing an octet boundary",
+			start:    "10.0.0.255",
+			end:      "10.0.1.0",
+			expected: []string{"10.0.0.255/32", "10.0.1.0/32"},
+		},
+		{
+			name:     "every address",
+			start:    "0.0.0.0",
+			end:      "255.255.255.255",
+			expected: []string{"0.0.0.0/0"},
+		},
+		{
+			name:     "top of the address space",
+			start:    "255.255.255.254",
+			end:      "255.255.255.255",
+			expected: []string{"255.255.255.254/31"},
+		},
+		{
+			name:     "bottom of the address space",
+			start:    "0.0.0.0",
+			end:      "0.0.0.2",
+			expected: []string{"0.0.0.0/31", "0.0.0.2/32"},
+		},
+		{
+			name:     "single ipv6 address",
+			start:    "2001:db8::1",
+			expected: []string{"2001:db8::1/128"},
+		},
+		{
+			name:     "ipv6 block",
+			start:    "2001:db8::",
+			end:      "2001:db8::ffff",
+			expected: []string{"2001:db8::/112"},
+		},
+		{
+			name:     "unaligned ipv6 range",
+			start:    "2001:db8::1",
+			end:      "2001:db8::4",
+			expected: []string{"2001:db8::1/128", "2001:db8::2/127", "2001:db8::4/128"},
+		},
+		{
+			name:  "reversed range",
+			start: "10.0.0.2",
+			end:   "10.0.0.1",
+			err:   true,
+		},
+		{
+			name:  "mixed address families",
+			start: "10.0.0.1",
+			end:   "::1",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ipRange := garden.IPRange{Start: net.ParseIP(test.start)}
+			if test.end != "" {
+				ipRange.End = net.ParseIP(test.end)
+			}
+
+			cidrs, err := cidrsForRange(ipRange)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", cidrs)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(cidrs, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, cidrs)
+			}
+		})
+	}
+}
+
+func TestEgressRule(t *testing.T) {
+	tcp, udp := corev1.ProtocolTCP, corev1.ProtocolUDP
+	port80, endPort90 := intstr.FromInt(80), int32(90)
+
+	tests := []struct {
+		name     string
+		rule     garden.NetOutRule
+		expected networkingv1.NetworkPolicyEgressRule
+		err      bool
+	}{
+		{
+			name: "all traffic to a network",
+			rule: garden.NetOutRule{
+				Protocol: garden.ProtocolAll,
+				Networks: []garden.IPRange{{Start: net.ParseIP("10.0.0.0"), End: net.ParseIP("10.0.0.255")}},
+			},
+			expected: networkingv1.NetworkPolicyEgressRule{
+				To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24"}}},
+			},
+		},
+		{
+			name: "all protocols on a port range",
+			rule: garden.NetOutRule{
+				Protocol: garden.ProtocolAll,
+				Ports:    []garden.PortRange{{Start: 80, End: 90}},
+			},
+			expected: networkingv1.NetworkPolicyEgressRule{
+				Ports: []networkingv1.NetworkPolicyPort{
+					{Protocol: &tcp, Port: &port80, EndPort: &endPort90},
+					{Protocol: &udp, Port: &port80, EndPort: &endPort90},
+				},
+			},
+		},
+		{
+			name: "single tcp port",
+			rule: garden.NetOutRule{
+				Protocol: garden.ProtocolTCP,
+				Ports:    []garden.PortRange{{Start: 80, End: 80}},
+			},
+			expected: networkingv1.NetworkPolicyEgressRule{
+				Ports: []networkingv1.NetworkPolicyPort{
+					{Protocol: &tcp, Port: &port80},
+				},
+			},
+		},
+		{
+			name: "any udp port",
+			rule: garden.NetOutRule{
+				Protocol: garden.ProtocolUDP,
+			},
+			expected: networkingv1.NetworkPolicyEgressRule{
+				Ports: []networkingv1.NetworkPolicyPort{
+					{Protocol: &udp},
+				},
+			},
+		},
+		{
+			name: "icmp",
+			rule: garden.NetOutRule{
+				Protocol: garden.ProtocolICMP,
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := egressRule(test.rule)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", rule)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(rule, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, rule)
+			}
+		})
+	}
+}
+
+func TestBulkNetOutWithoutDenyingEgress(t *testing.T) {
+	// without a client, creating a network policy would panic
+	container := Container{
+		config: Config{DenyNetworkEgress: false},
+		pod: corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "container",
+				Labels: map[string]string{containerLabelKey: "id"},
+			},
+		},
+	}
+
+	err := container.NetOut(garden.NetOutRule{
+		Protocol: garden.ProtocolTCP,
+		Networks: []garden.IPRange{garden.IPRangeFromIP(net.ParseIP("10.0.0.1"))},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = container.NetOut(garden.NetOutRule{Protocol: garden.ProtocolICMP})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported rule")
+	}
+}
@@ -0,0 +1,97 @@
+package garden
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	pingTimeout = 10 * time.Second
+)
+
+var (
+	// the access the garden server needs to do anything useful with a
+	// container; anything else degrades only parts of the api
+	requiredAccess = []authorizationv1.ResourceAttributes{
+		{Verb: "create", Resource: "pods"},
+		{Verb: "create", Resource: "pods", Subresource: "exec"},
+		{Verb: "delete", Resource: "pods"},
+	}
+)
+
+// healthCheck caches the result of checking whether the kubernetes api is
+// usable, as the atc pings frequently and the checks aren't free
+type healthCheck struct {
+	mu sync.Mutex
+
+	checkedAt time.Time
+	err       error
+}
+
+func (backend *GardenBackend) Ping() error {
+	backend.health.mu.Lock()
+	defer backend.health.mu.Unlock()
+
+	if time.Since(backend.health.checkedAt) < backend.config.PingCacheDuration {
+		return backend.health.err
+	}
+
+	backend.health.err = backend.checkHealth()
+	backend.health.checkedAt = time.Now()
+
+	return backend.health.err
+}
+
+func (backend *GardenBackend) checkHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	_, err := backend.client.Discovery().RESTClient().
+		Get().
+		AbsPath("/version").
+		Do(ctx).
+		Raw()
+
+	if err != nil {
+		return garden.NewServiceUnavailableError(fmt.Sprintf("kubernetes api is unreachable: %s", err))
+	}
+
+	for _, access := range requiredAccess {
+		access.Namespace = backend.config.Namespace
+
+		review, err := backend.client.AuthorizationV1().
+			SelfSubjectAccessReviews().
+			Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &access,
+				},
+			}, metav1.CreateOptions{})
+
+		if err != nil {
+			return garden.NewServiceUnavailableError(fmt.Sprintf("failed to review access: %s", err))
+		}
+
+		if !review.Status.Allowed {
+			resource := access.Resource
+			if access.Subresource != "" {
+				resource = resource + "/" + access.Subresource
+			}
+
+			return garden.NewServiceUnavailableError(fmt.Sprintf(
+				"not allowed to %s %s in namespace '%s': %s",
+				access.Verb,
+				resource,
+				access.Namespace,
+				review.Status.Reason,
+			))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,502 @@
+package garden
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"github.com/concourse/kubernetes-worker/pkg/baggageclaimcsi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	stepContainerName = "step"
+
+	initVolumeName = "concourse-init"
+	initBinaryPath = "/.concourse/bin/init"
+
+	processesVolumeName = "concourse-processes"
+
+	// rootfs volumes are mounted alongside init, which runs processes inside
+	// of them
+	rootfsVolumeName = "concourse-rootfs"
+	rootfsPath       = "/.concourse/rootfs"
+
+	// rootMountCapability lets init mount /dev, /proc and /sys into a rootfs
+	// volume, without making the whole container privileged. init drops it
+	// before running any of the container's processes.
+	rootMountCapability = corev1.Capability("SYS_ADMIN")
+
+	// readyFile is written by init once the container has started. Process
+	// directories are named in base32hex, which can't clash with it.
+	readyFile          = processesPath + "/.ready"
+	readyProbeInterval = 1
+
+	initBinaryAttribute   = "baggageclaim.k8s.concourse-ci.org/init-binary"
+	volumeHandleAttribute = "baggageclaim.k8s.concourse-ci.org/handle"
+)
+
+var (
+	// waiting reasons which a container won't recover from without someone
+	// changing the pod spec, so there's no point waiting for it to start
+	fatalWaitingReasons = map[string]bool{
+		"ErrImagePull":               true,
+		"ImagePullBackOff":           true,
+		"InvalidImageName":           true,
+		"CreateContainerConfigError": true,
+		"CreateContainerError":       true,
+	}
+)
+
+func (backend *GardenBackend) podForSpec(spec garden.ContainerSpec) (*corev1.Pod, error) {
+	image, rawRootfs, err := imageForSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := envVars(spec.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations, err := propertyAnnotations(spec.Properties)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range graceTimeAnnotations(spec.GraceTime, time.Now()) {
+		annotations[key] = value
+	}
+
+	volumes, mounts := backend.initVolume()
+
+	volumes = append(volumes, corev1.Volume{
+		Name: processesVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	mounts = append(mounts, corev1.VolumeMount{
+		Name:      processesVolumeName,
+		MountPath: processesPath,
+	})
+
+	command := []string{initBinaryPath, "--sleep", "--ready-file", readyFile}
+	pullPolicy := corev1.PullPolicy("")
+	var capabilities *corev1.Capabilities
+
+	// a rootfs from a baggageclaim volume is run on a base image, which
+	// already exists on the node from running other such containers
+	root := ""
+	if rawRootfs != "" {
+		if backend.config.RawImageBase == "" {
+			return nil, errors.New("no base image configured for raw images")
+		}
+
+		rootfsVolume, rootfsMount, err := backend.rootfsVolume(rawRootfs)
+		if err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, rootfsVolume)
+		mounts = append(mounts, rootfsMount)
+
+		image = backend.config.RawImageBase
+		pullPolicy = corev1.PullIfNotPresent
+		root = rootfsPath
+
+		command = append(command, "--root", root)
+
+		if !spec.Privileged {
+			capabilities = &corev1.Capabilities{
+				Add: []corev1.Capability{rootMountCapability},
+			}
+		}
+	}
+
+	bindVolumes, bindMounts, err := backend.bindMountVolumes(spec.BindMounts, root)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes = append(volumes, bindVolumes...)
+	mounts = append(mounts, bindMounts...)
+
+	command = append(command, chownArgs(spec)...)
+
+	objectMeta := metav1.ObjectMeta{
+		Name:      spec.Handle,
+		Namespace: backend.config.Namespace,
+
+		Labels: map[string]string{
+			workerLabelKey:    backend.config.WorkerName,
+			containerLabelKey: string(uuid.NewUUID()),
+		},
+		Annotations: annotations,
+	}
+
+	if spec.Handle == "" {
+		objectMeta.GenerateName = "garden-"
+	}
+
+	privileged := spec.Privileged
+	automountToken := false
+	enableServiceLinks := false
+
+	return &corev1.Pod{
+		ObjectMeta: objectMeta,
+		Spec: corev1.PodSpec{
+			// baggageclaim volumes only exist on this worker's node, so every
+			// step has to be scheduled alongside it
+			NodeName:      backend.config.NodeName,
+			RestartPolicy: corev1.RestartPolicyNever,
+
+			AutomountServiceAccountToken: &automountToken,
+			EnableServiceLinks:           &enableServiceLinks,
+
+			Containers: []corev1.Container{{
+				Name:            stepContainerName,
+				Image:           image,
+				ImagePullPolicy: pullPolicy,
+				Command:         command,
+				Env:             env,
+
+				// init logs why it failed to start the container
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+
+				// exec'ing into the container only makes sense once init
+				// has finished preparing it. Without a readiness probe, the
+				// pod becomes ready as soon as this succeeds, and is never
+				// probed again.
+				StartupProbe: &corev1.Probe{
+					ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{
+							Command: []string{initBinaryPath, "--check-ready", readyFile},
+						},
+					},
+					PeriodSeconds:    readyProbeInterval,
+					FailureThreshold: backend.readyProbeThreshold(),
+				},
+
+				Resources:    resourcesForLimits(backend.effectiveLimits(spec.Limits)),
+				VolumeMounts: mounts,
+
+				SecurityContext: &corev1.SecurityContext{
+					Privileged:   &privileged,
+					Capabilities: capabilities,
+				},
+			}},
+			Volumes: volumes,
+		},
+	}, nil
+}
+
+// readyProbeThreshold gives init until the pod start timeout to get ready,
+// at which point Create gives up on the pod anyway
+func (backend *GardenBackend) readyProbeThreshold() int32 {
+	threshold := int32(backend.config.PodStartTimeout/time.Second) / readyProbeInterval
+	if threshold < 1 {
+		return 1
+	}
+
+	return threshold + 1
+}
+
+func (backend *GardenBackend) initVolume() ([]corev1.Volume, []corev1.VolumeMount) {
+	readOnly := true
+
+	volume := corev1.Volume{
+		Name: initVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			CSI: &corev1.CSIVolumeSource{
+				Driver:   backend.config.CsiDriverName,
+				ReadOnly: &readOnly,
+				VolumeAttributes: map[string]string{
+					initBinaryAttribute: "true",
+				},
+			},
+		},
+	}
+
+	mount := corev1.VolumeMount{
+		Name:      initVolumeName,
+		MountPath: initBinaryPath,
+		ReadOnly:  true,
+	}
+
+	return []corev1.Volume{volume}, []corev1.VolumeMount{mount}
+}
+
+// rootfsVolume publishes the baggageclaim volume holding a container's rootfs
+// into its pod
+func (backend *GardenBackend) rootfsVolume(rootfs string) (corev1.Volume, corev1.VolumeMount, error) {
+	vol, subPath, found, err := baggageclaimcsi.LookupVolumeByPath(backend.baggageclaim, rootfs)
+	if err != nil {
+		return corev1.Volume{}, corev1.VolumeMount{}, fmt.Errorf("failed to lookup volume for rootfs '%s': %w", rootfs, err)
+	}
+
+	if !found {
+		return corev1.Volume{}, corev1.VolumeMount{}, fmt.Errorf("rootfs '%s' is not in a baggageclaim volume", rootfs)
+	}
+
+	volume := corev1.Volume{
+		Name: rootfsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			CSI: &corev1.CSIVolumeSource{
+				Driver: backend.config.CsiDriverName,
+				VolumeAttributes: map[string]string{
+					volumeHandleAttribute: vol.Handle(),
+				},
+			},
+		},
+	}
+
+	mount := corev1.VolumeMount{
+		Name:      rootfsVolumeName,
+		MountPath: rootfsPath,
+		SubPath:   subPath,
+	}
+
+	return volume, mount, nil
+}
+
+// bindMountVolumes publishes the baggageclaim volumes behind a container's bind
+// mounts into its pod, mounted under root if the container has a rootfs volume
+func (backend *GardenBackend) bindMountVolumes(bindMounts []garden.BindMount, root string) ([]corev1.Volume, []corev1.VolumeMount, error) {
+	volumes := []corev1.Volume{}
+	mounts := make([]corev1.VolumeMount, 0, len(bindMounts))
+
+	// several bind mounts can point into the same baggageclaim volume, which
+	// only needs publishing into the pod once
+	volumeNames := map[string]string{}
+
+	for _, bindMount := range bindMounts {
+		vol, subPath, found, err := baggageclaimcsi.LookupVolumeByPath(backend.baggageclaim, bindMount.SrcPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to lookup volume for bind mount '%s': %w", bindMount.SrcPath, err)
+		}
+
+		if !found {
+			return nil, nil, fmt.Errorf("bind mount source '%s' is not in a baggageclaim volume", bindMount.SrcPath)
+		}
+
+		name, ok := volumeNames[vol.Handle()]
+		if !ok {
+			name = fmt.Sprintf("bind-mount-%d", len(volumes))
+			volumeNames[vol.Handle()] = name
+
+			volumes = append(volumes, corev1.Volume{
+				Name: name,
+				VolumeSource: corev1.VolumeSource{
+					CSI: &corev1.CSIVolumeSource{
+						Driver: backend.config.CsiDriverName,
+						VolumeAttributes: map[string]string{
+							volumeHandleAttribute: vol.Handle(),
+						},
+					},
+				},
+			})
+		}
+
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: path.Join("/", root, bindMount.DstPath),
+			SubPath:   subPath,
+			ReadOnly:  bindMount.Mode == garden.BindMountModeRO,
+		})
+	}
+
+	return volumes, mounts, nil
+}
+
+// chownArgs has init hand writable bind mounts over to the user the
+// container's processes run as, as they're otherwise owned by root
+func chownArgs(spec garden.ContainerSpec) []string {
+	user := spec.Properties[userProperty]
+	if user == "" || user == "root" || user == "0" || strings.HasPrefix(user, "0:") {
+		return nil
+	}
+
+	args := []string{"--user", user}
+	for _, bindMount := range spec.BindMounts {
+		if bindMount.Mode == garden.BindMountModeRW {
+			args = append(args, "--chown", bindMount.DstPath)
+		}
+	}
+
+	if len(args) == 2 {
+		return nil
+	}
+
+	return args
+}
+
+// imageForSpec finds the image a container runs, or for a raw image, the path
+// of its rootfs
+func imageForSpec(spec garden.ContainerSpec) (string, string, error) {
+	uri := spec.Image.URI
+	if uri == "" {
+		uri = spec.RootFSPath
+	}
+
+	if uri == "" {
+		return "", "", errors.New("no image specified")
+	}
+
+	imageUrl, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse image uri '%s': %w", uri, err)
+	}
+
+	switch imageUrl.Scheme {
+	case "docker":
+		// garden formats images as docker://[registry]/repository#tag
+		image := strings.TrimPrefix(path.Join(imageUrl.Host, imageUrl.Path), "/")
+		if imageUrl.Fragment != "" {
+			image = image + ":" + imageUrl.Fragment
+		}
+
+		return image, "", nil
+
+	case "raw":
+		// rootfs volumes produced by concourse, formatted as raw:///path
+		return "", imageUrl.Path, nil
+
+	default:
+		return "", "", fmt.Errorf("unsupported image uri scheme '%s'", imageUrl.Scheme)
+	}
+}
+
+func envVars(env []string) ([]corev1.EnvVar, error) {
+	vars := make([]corev1.EnvVar, 0, len(env))
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed environment variable '%s'", e)
+		}
+
+		vars = append(vars, corev1.EnvVar{
+			Name:  parts[0],
+			Value: parts[1],
+		})
+	}
+
+	return vars, nil
+}
+
+func (backend *GardenBackend) waitForPodReady(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, error) {
+	fieldSelector := fmt.Sprintf("metadata.name=%s", pod.Name)
+	watcher := &cache.ListWatch{
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return backend.client.CoreV1().
+				Pods(pod.Namespace).
+				Watch(ctx, options)
+		},
+	}
+
+	event, err := watchtools.Until(ctx, pod.ResourceVersion, watcher, podReady)
+	if err != nil {
+		if errors.Is(err, wait.ErrWaitTimeout) {
+			return nil, fmt.Errorf("timed out waiting for pod '%s' to become ready", pod.Name)
+		}
+
+		return nil, err
+	}
+
+	return event.Object.(*corev1.Pod), nil
+}
+
+func podReady(event watch.Event) (bool, error) {
+	if event.Type == watch.Deleted {
+		return false, errors.New("pod was deleted before it started")
+	}
+
+	pod, ok := event.Object.(*corev1.Pod)
+	if !ok {
+		return false, fmt.Errorf("unexpected object in watch: %T", event.Object)
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodRunning:
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+				return true, nil
+			}
+		}
+
+	case corev1.PodFailed, corev1.PodSucceeded:
+		for _, status := range pod.Status.ContainerStatuses {
+			if terminated := status.State.Terminated; terminated != nil && status.Name == stepContainerName {
+				return false, fmt.Errorf("container '%s' exited before it started (exit status: %d): %s", status.Name, terminated.ExitCode, terminated.Message)
+			}
+		}
+
+		return false, fmt.Errorf("pod exited before it started (phase: %s, reason: %s)", pod.Status.Phase, pod.Status.Reason)
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && fatalWaitingReasons[waiting.Reason] {
+			return false, fmt.Errorf("container '%s' failed to start: %s: %s", status.Name, waiting.Reason, waiting.Message)
+		}
+	}
+
+	return false, nil
+}
+
+// podRoot is where a pod's rootfs volume is mounted, if it has one
+func podRoot(pod corev1.Pod) string {
+	container, found := stepContainer(pod)
+	if !found {
+		return ""
+	}
+
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == rootfsVolumeName {
+			return mount.MountPath
+		}
+	}
+
+	return ""
+}
+
+// droppedCapabilities are the capabilities a pod's step container was only
+// given for init's sake, which init drops before running any processes
+func droppedCapabilities(pod corev1.Pod) []string {
+	container, found := stepContainer(pod)
+	if !found || container.SecurityContext == nil || container.SecurityContext.Capabilities == nil {
+		return nil
+	}
+
+	if privileged := container.SecurityContext.Privileged; privileged != nil && *privileged {
+		return nil
+	}
+
+	var dropped []string
+	for _, capability := range container.SecurityContext.Capabilities.Add {
+		dropped = append(dropped, string(capability))
+	}
+
+	return dropped
+}
+
+func stepContainer(pod corev1.Pod) (corev1.Container, bool) {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == stepContainerName {
+			return container, true
+		}
+	}
+
+	return corev1.Container{}, false
+}
@@ -0,0 +1,135 @@
+package garden
+
+import (
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/garden"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestImageForSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      garden.ContainerSpec
+		image     string
+		rawRootfs string
+		err       bool
+	}{
+		{
+			name:  "docker image with registry and tag",
+			spec:  garden.ContainerSpec{Image: garden.ImageRef{URI: "docker://registry.example.com/repo/image#1.0"}},
+			image: "registry.example.com/repo/image:1.0",
+		},
+		{
+			name:  "docker image without registry",
+			spec:  garden.ContainerSpec{Image: garden.ImageRef{URI: "docker:///busybox"}},
+			image: "busybox",
+		},
+		{
+			name:      "raw rootfs",
+			spec:      garden.ContainerSpec{Image: garden.ImageRef{URI: "raw:///volumes/handle/rootfs"}},
+			rawRootfs: "/volumes/handle/rootfs",
+		},
+		{
+			name:  "rootfs path",
+			spec:  garden.ContainerSpec{RootFSPath: "docker:///busybox#latest"},
+			image: "busybox:latest",
+		},
+		{
+			name:  "image takes precedence over rootfs path",
+			spec:  garden.ContainerSpec{Image: garden.ImageRef{URI: "docker:///alpine"}, RootFSPath: "docker:///busybox"},
+			image: "alpine",
+		},
+		{
+			name: "no image",
+			spec: garden.ContainerSpec{},
+			err:  true,
+		},
+		{
+			name: "unsupported scheme",
+			spec: garden.ContainerSpec{Image: garden.ImageRef{URI: "oci:///image"}},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image, rawRootfs, err := imageForSpec(test.spec)
+
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q, %q", image, rawRootfs)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if image != test.image || rawRootfs != test.rawRootfs {
+				t.Errorf("expected %q, %q, got %q, %q", test.image, test.rawRootfs, image, rawRootfs)
+			}
+		})
+	}
+}
+
+func TestDroppedCapabilities(t *testing.T) {
+	privileged := true
+	unprivileged := false
+
+	tests := []struct {
+		name            string
+		securityContext *corev1.SecurityContext
+		expected        []string
+	}{
+		{
+			name: "no security context",
+		},
+		{
+			name: "no added capabilities",
+			securityContext: &corev1.SecurityContext{
+				Privileged: &unprivileged,
+			},
+		},
+		{
+			name: "added capabilities",
+			securityContext: &corev1.SecurityContext{
+				Privileged: &unprivileged,
+				Capabilities: &corev1.Capabilities{
+					Add: []corev1.Capability{rootMountCapability},
+				},
+			},
+			expected: []string{"SYS_ADMIN"},
+		},
+		{
+			name: "privileged",
+			securityContext: &corev1.SecurityContext{
+				Privileged: &privileged,
+				Capabilities: &corev1.Capabilities{
+					Add: []corev1.Capability{rootMountCapability},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:            stepContainerName,
+						SecurityContext: test.securityContext,
+					}},
+				},
+			}
+
+			dropped := droppedCapabilities(pod)
+			if !reflect.DeepEqual(dropped, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, dropped)
+			}
+		})
+	}
+}
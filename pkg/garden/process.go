@@ -0,0 +1,318 @@
+package garden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"k8s.io/client-go/util/exec"
+)
+
+const (
+	processAnnotationPrefix = "processes.garden.k8s.concourse-ci.org/"
+	processRunningStatus    = "running"
+
+	// processesPath is where init keeps the state of detached processes
+	processesPath = "/.concourse/processes"
+
+	// maxBufferedOutput is how much of each output stream is kept around
+	// to replay to clients which attach to a process after it started
+	maxBufferedOutput = 1024 * 1024
+
+	// maxEnvArgsSize is the most environment passed to init as arguments,
+	// which end up in the exec request's url
+	maxEnvArgsSize = 32 * 1024
+
+	// a broken exec session doesn't affect the process itself, which init
+	// keeps running, so it's attached to again a few times before giving up
+	maxReattachAttempts = 5
+	reattachInterval    = 2 * time.Second
+
+	// exitedProcessRetention is how long an exited process' output is kept
+	// around for; after that, attaching only reports its exit status
+	exitedProcessRetention = 5 * time.Minute
+)
+
+type Process struct {
+	id string
+
+	stdout *processOutput
+	stderr *processOutput
+
+	done       chan struct{}
+	exitStatus int
+	err        error
+
+	tty bool
+
+	// control passes requests on to the init keeping the process, which is
+	// the only way to reach it outside of its exec session
+	control func(args ...string) error
+}
+
+var _ garden.Process = &Process{}
+
+func newProcess(id string, tty bool, control func(args ...string) error) *Process {
+	return &Process{
+		id: id,
+
+		stdout: &processOutput{},
+		stderr: &processOutput{},
+
+		done: make(chan struct{}),
+
+		tty:     tty,
+		control: control,
+	}
+}
+
+// newExitedProcess represents a process which finished before the current
+// garden server started, where all that's left of it is its exit status
+func newExitedProcess(id string, exitStatus int) *Process {
+	process := newProcess(id, false, nil)
+	process.exitStatus = exitStatus
+	close(process.done)
+
+	return process
+}
+
+// processDir is the directory init keeps a detached process' state in.
+// Process IDs aren't necessarily safe to use in a path, so they're encoded in
+// the same way as annotation keys.
+func processDir(id string) string {
+	return path.Join(processesPath, strings.ToLower(annotationEncoding.EncodeToString([]byte(id))))
+}
+
+// processEnvFile is where a process' environment is written when it's too
+// big to pass to init as arguments. It sits alongside the process' directory,
+// which init insists on creating itself.
+func processEnvFile(id string) string {
+	return processDir(id) + ".env"
+}
+
+func envSize(env []string) int {
+	size := 0
+	for _, e := range env {
+		size += len(e)
+	}
+
+	return size
+}
+
+func (p *Process) ID() string {
+	return p.id
+}
+
+func (p *Process) Wait() (int, error) {
+	<-p.done
+	return p.exitStatus, p.err
+}
+
+func (p *Process) SetTTY(spec garden.TTYSpec) error {
+	if !p.tty {
+		return errors.New("process was not started with a tty")
+	}
+
+	if spec.WindowSize == nil || p.exited() {
+		return nil
+	}
+
+	return p.control("--resize", windowSize(spec.WindowSize))
+}
+
+func (p *Process) Signal(signal garden.Signal) error {
+	if p.exited() {
+		return nil
+	}
+
+	switch signal {
+	case garden.SignalTerminate:
+		return p.control("--signal", "TERM")
+
+	case garden.SignalKill:
+		return p.control("--signal", "KILL")
+
+	default:
+		return fmt.Errorf("unknown signal %d", signal)
+	}
+}
+
+// attach replays any buffered output to the given streams, and then
+// forwards any further output until the process exits
+func (p *Process) attach(processIO garden.ProcessIO) {
+	p.stdout.attach(processIO.Stdout)
+	p.stderr.attach(processIO.Stderr)
+}
+
+func (p *Process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish records the result of streaming the process' exec session,
+// translating the exec subresource's exit errors into an exit status
+func (p *Process) finish(err error) {
+	var exitErr exec.CodeExitError
+	if errors.As(err, &exitErr) {
+		p.exitStatus = exitErr.Code
+	} else if err != nil {
+		p.exitStatus = -1
+		p.err = err
+	}
+
+	close(p.done)
+}
+
+// streamBroken reports whether an exec session ended without the process
+// itself exiting
+func streamBroken(err error) bool {
+	var exitErr exec.CodeExitError
+	return err != nil && !errors.As(err, &exitErr)
+}
+
+type processOutput struct {
+	mu sync.Mutex
+
+	buffer  bytes.Buffer
+	writers []io.Writer
+
+	// written counts everything ever written, including anything since
+	// dropped from the buffer
+	written int64
+}
+
+var _ io.Writer = &processOutput{}
+
+func (o *processOutput) Write(data []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.written += int64(len(data))
+
+	o.buffer.Write(data)
+	if overflow := o.buffer.Len() - maxBufferedOutput; overflow > 0 {
+		o.buffer.Next(overflow)
+	}
+
+	// a client going away shouldn't stop the process, or any other client
+	// from receiving its output
+	writers := o.writers[:0]
+	for _, writer := range o.writers {
+		if _, err := writer.Write(data); err == nil {
+			writers = append(writers, writer)
+		}
+	}
+	o.writers = writers
+
+	return len(data), nil
+}
+
+// size is how much output has been written, which is where it picks up from
+// when attaching to the process again
+func (o *processOutput) size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.written
+}
+
+func (o *processOutput) attach(writer io.Writer) {
+	if writer == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := writer.Write(o.buffer.Bytes()); err != nil {
+		return
+	}
+
+	o.writers = append(o.writers, writer)
+}
+
+// processTracker keeps track of the processes started in each container, so
+// they can be attached to by later requests
+type processTracker struct {
+	mu sync.Mutex
+
+	processes map[string]map[string]*Process
+}
+
+func newProcessTracker() *processTracker {
+	return &processTracker{
+		processes: map[string]map[string]*Process{},
+	}
+}
+
+func (t *processTracker) track(handle string, process *Process) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	processes, found := t.processes[handle]
+	if !found {
+		processes = map[string]*Process{}
+		t.processes[handle] = processes
+	}
+
+	if _, found := processes[process.ID()]; found {
+		return fmt.Errorf("process '%s' already exists", process.ID())
+	}
+
+	processes[process.ID()] = process
+	return nil
+}
+
+func (t *processTracker) lookup(handle, id string) (*Process, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	process, found := t.processes[handle][id]
+	return process, found
+}
+
+// untrack stops tracking a process, unless it has since been replaced by
+// another with the same ID
+func (t *processTracker) untrack(handle string, process *Process) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.processes[handle][process.ID()] == process {
+		delete(t.processes[handle], process.ID())
+	}
+}
+
+func (t *processTracker) hasRunning(handle string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, process := range t.processes[handle] {
+		if !process.exited() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *processTracker) forget(handle string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.processes, handle)
+}
+
+// windowSize formats a window size the way init expects it
+func windowSize(size *garden.WindowSize) string {
+	return fmt.Sprintf("%dx%d", size.Columns, size.Rows)
+}
@@ -0,0 +1,90 @@
+package garden
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/garden"
+)
+
+const (
+	propertyAnnotationPrefix = "properties.garden.k8s.concourse-ci.org/"
+
+	// userProperty is set by concourse to the user a container's image runs
+	// processes as
+	userProperty = "user"
+)
+
+func propertyAnnotations(properties garden.Properties) (map[string]string, error) {
+	annotations := make(map[string]string, len(properties))
+	for name, value := range properties {
+		key, err := encodeAnnotationKey(propertyAnnotationPrefix, name)
+		if err != nil {
+			return nil, err
+		}
+
+		annotations[key] = value
+	}
+
+	return annotations, nil
+}
+
+func propertiesFromAnnotations(annotations map[string]string) garden.Properties {
+	properties := garden.Properties{}
+	for key, value := range annotations {
+		if name, found := decodeAnnotationKey(propertyAnnotationPrefix, key); found {
+			properties[name] = value
+		}
+	}
+
+	return properties
+}
+
+func matchesProperties(properties garden.Properties, filter garden.Properties) bool {
+	for name, value := range filter {
+		if actual, found := properties[name]; !found || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c Container) Properties() (garden.Properties, error) {
+	return propertiesFromAnnotations(c.pod.Annotations), nil
+}
+
+func (c Container) Property(name string) (string, error) {
+	key, err := encodeAnnotationKey(propertyAnnotationPrefix, name)
+	if err != nil {
+		return "", err
+	}
+
+	value, found := c.pod.Annotations[key]
+	if !found {
+		return "", fmt.Errorf("property does not exist: %s", name)
+	}
+
+	return value, nil
+}
+
+func (c Container) SetProperty(name string, value string) error {
+	key, err := encodeAnnotationKey(propertyAnnotationPrefix, name)
+	if err != nil {
+		return err
+	}
+
+	return c.patchAnnotations(map[string]*string{key: &value})
+}
+
+func (c Container) RemoveProperty(name string) error {
+	key, err := encodeAnnotationKey(propertyAnnotationPrefix, name)
+	if err != nil {
+		return err
+	}
+
+	if _, found := c.pod.Annotations[key]; !found {
+		return fmt.Errorf("property does not exist: %s", name)
+	}
+
+	return c.patchAnnotations(map[string]*string{key: nil})
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"net"
 	"sync"
+	"time"
 
 	"code.cloudfoundry.org/garden/server"
 	"code.cloudfoundry.org/lager"
+	"github.com/concourse/concourse/worker/baggageclaim"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 // import "sigs.k8s.io/controller-runtime/pkg/manager"
@@ -17,19 +20,27 @@ type GardenServer struct {
 	logger lager.Logger
 	config Config
 
-	server *server.GardenServer
+	backend *GardenBackend
+	server  *server.GardenServer
 }
 
 func NewGardenServer(
 	logger lager.Logger,
 	cfg Config,
 	client *kubernetes.Clientset,
-) *GardenServer {
-	backend := NewGardenBackend(cfg, client)
+	restConfig *rest.Config,
+	baggageclaimClient baggageclaim.Client,
+) (*GardenServer, error) {
+	backend, err := NewGardenBackend(cfg, client, restConfig, baggageclaimClient)
+	if err != nil {
+		return nil, err
+	}
+
 	return &GardenServer{
 		logger: logger,
 		config: cfg,
 
+		backend: &backend,
 		server: server.New(
 			cfg.BindNetwork,
 			cfg.BindAddress,
@@ -37,7 +48,7 @@ func NewGardenServer(
 			&backend,
 			logger,
 		),
-	}
+	}, nil
 }
 
 func (backend *GardenServer) Start(ctx context.Context) error {
@@ -46,6 +57,12 @@ func (backend *GardenServer) Start(ctx context.Context) error {
 		"address": backend.config.BindAddress,
 	})
 
+	if err := backend.backend.Start(); err != nil {
+		return err
+	}
+
+	// the server's handlers expect a bomberman, even though containers are
+	// reaped by reapExpiredContainers instead (see GardenBackend.GraceTime)
 	if err := backend.server.SetupBomberman(); err != nil {
 		return err
 	}
@@ -59,7 +76,7 @@ func (backend *GardenServer) Start(ctx context.Context) error {
 	}
 
 	wg := sync.WaitGroup{}
-	wg.Add(1)
+	wg.Add(2)
 
 	go func() {
 		err = backend.server.Serve(listener)
@@ -70,6 +87,11 @@ func (backend *GardenServer) Start(ctx context.Context) error {
 		wg.Done()
 	}()
 
+	go func() {
+		backend.reapExpiredContainers(ctx)
+		wg.Done()
+	}()
+
 	<-ctx.Done()
 	backend.logger.Info("stopping-server")
 	backend.server.Stop()
@@ -79,3 +101,35 @@ func (backend *GardenServer) Start(ctx context.Context) error {
 
 	return err
 }
+
+// reapExpiredContainers periodically destroys containers which have gone
+// unused for longer than their grace time, until the context is cancelled
+func (backend *GardenServer) reapExpiredContainers(ctx context.Context) {
+	logger := backend.logger.Session("reaper")
+
+	ticker := time.NewTicker(backend.config.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			// containers found to have expired are reaped, even if others
+			// couldn't be checked
+			handles, err := backend.backend.expiredContainers(now)
+			if err != nil {
+				logger.Error("failed-to-find-expired-containers", err)
+			}
+
+			for _, handle := range handles {
+				logger.Info("reaping-container", lager.Data{"handle": handle})
+
+				if err := backend.backend.Destroy(handle); err != nil {
+					logger.Error("failed-to-reap-container", err, lager.Data{"handle": handle})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package garden
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/garden"
+	"github.com/concourse/concourse/worker/baggageclaim"
+	"github.com/concourse/kubernetes-worker/pkg/baggageclaimcsi"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func (c Container) StreamIn(spec garden.StreamInSpec) error {
+	if err := c.touch(); err != nil {
+		return err
+	}
+
+	// going straight to baggageclaim skips the permission checks a user
+	// would be subject to, so is only done when streaming in as root
+	if spec.User == "" {
+		vol, subPath, found, err := c.volumeForPath(spec.Path, true)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			reader, writer := io.Pipe()
+			go func() {
+				writer.CloseWithError(gzipStream(writer, spec.TarStream))
+			}()
+
+			defer reader.Close()
+			return vol.StreamIn(context.Background(), subPath, baggageclaim.GzipEncoding, reader)
+		}
+	}
+
+	command := append([]string{initBinaryPath, "--stream-in", spec.Path}, c.rootArgs()...)
+	if spec.User != "" {
+		command = append(command, "--user", spec.User)
+	}
+
+	executor, err := c.executor(command, true)
+	if err != nil {
+		return err
+	}
+
+	stderr := new(bytes.Buffer)
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdin:  spec.TarStream,
+		Stdout: io.Discard,
+		Stderr: stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stream in to '%s': %w (stderr: %q)", spec.Path, err, stderr.String())
+	}
+
+	return nil
+}
+
+func (c Container) StreamOut(spec garden.StreamOutSpec) (io.ReadCloser, error) {
+	if err := c.touch(); err != nil {
+		return nil, err
+	}
+
+	// baggageclaim always streams out a directory's contents, which only
+	// matches garden's behaviour when the path has a trailing slash. As with
+	// streaming in, it's also only used for root.
+	if strings.HasSuffix(spec.Path, "/") && spec.User == "" {
+		vol, subPath, found, err := c.volumeForPath(spec.Path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			stream, err := vol.StreamOut(context.Background(), subPath, baggageclaim.GzipEncoding)
+			if err != nil {
+				return nil, err
+			}
+
+			return newGunzipReadCloser(stream)
+		}
+	}
+
+	command := append([]string{initBinaryPath, "--stream-out", spec.Path}, c.rootArgs()...)
+	if spec.User != "" {
+		command = append(command, "--user", spec.User)
+	}
+
+	executor, err := c.executor(command, false)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		stderr := new(bytes.Buffer)
+		err := executor.Stream(remotecommand.StreamOptions{
+			Stdout: writer,
+			Stderr: stderr,
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to stream out '%s': %w (stderr: %q)", spec.Path, err, stderr.String())
+		}
+
+		writer.CloseWithError(err)
+	}()
+
+	return reader, nil
+}
+
+// volumeForPath finds the baggageclaim volume mounted into the container at
+// the given path, along with the path's location inside of the volume. Paths
+// are inside the container's rootfs volume, if it has one, where the rootfs
+// itself is only used for paths outside of any bind mount. When writing, a
+// path in a read-only mount isn't found, leaving the write to fail inside the
+// container rather than modifying the volume behind the mount.
+func (c Container) volumeForPath(path string, write bool) (baggageclaim.Volume, string, bool, error) {
+	handles := map[string]string{}
+	for _, volume := range c.pod.Spec.Volumes {
+		if volume.CSI == nil {
+			continue
+		}
+
+		if handle, found := volume.CSI.VolumeAttributes[volumeHandleAttribute]; found {
+			handles[volume.Name] = handle
+		}
+	}
+
+	container, found := stepContainer(c.pod)
+	if !found {
+		return nil, "", false, nil
+	}
+
+	root := podRoot(c.pod)
+
+	var (
+		match         corev1.VolumeMount
+		matchPath     string
+		matchRelative string
+	)
+
+	for _, mount := range container.VolumeMounts {
+		if _, found := handles[mount.Name]; !found {
+			continue
+		}
+
+		mountPath := mount.MountPath
+		if root != "" {
+			inRoot, relative, err := baggageclaimcsi.IsSubPath(root, mountPath)
+			if err != nil || !inRoot {
+				continue
+			}
+
+			mountPath = filepath.Join("/", relative)
+		}
+
+		subPath, relative, err := baggageclaimcsi.IsSubPath(mountPath, path)
+		if err != nil || !subPath {
+			continue
+		}
+
+		// the most specific mount is the one the path ends up in
+		if matchPath == "" || len(mountPath) > len(matchPath) {
+			match, matchPath, matchRelative = mount, mountPath, relative
+		}
+	}
+
+	if matchPath == "" || (write && match.ReadOnly) {
+		return nil, "", false, nil
+	}
+
+	handle := handles[match.Name]
+
+	vol, found, err := c.baggageclaim.LookupVolume(context.Background(), handle)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if !found {
+		return nil, "", false, fmt.Errorf("volume '%s' mounted at '%s' no longer exists", handle, match.MountPath)
+	}
+
+	return vol, filepath.Join(match.SubPath, matchRelative), true, nil
+}
+
+func gzipStream(dest io.Writer, src io.Reader) error {
+	gzipWriter := gzip.NewWriter(dest)
+
+	_, err := io.Copy(gzipWriter, src)
+	if err != nil {
+		gzipWriter.Close()
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+type gunzipReadCloser struct {
+	*gzip.Reader
+	source io.ReadCloser
+}
+
+func newGunzipReadCloser(source io.ReadCloser) (io.ReadCloser, error) {
+	reader, err := gzip.NewReader(source)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	return gunzipReadCloser{Reader: reader, source: source}, nil
+}
+
+func (r gunzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.source.Close()
+}